@@ -2,7 +2,7 @@
 package main
 
 import (
-	"fmt"
+	"errors"
 	"os"
 
 	"email-manager/internal/cli"
@@ -11,8 +11,10 @@ import (
 func main() {
 	cli.Init()
 
-	if err := cli.RootCmd.Execute(); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+	if err := cli.Execute(); err != nil {
+		if !errors.Is(err, cli.ErrNoMessages) {
+			cli.PrintError(err)
+		}
+		os.Exit(cli.ExitCode(err))
 	}
 }
@@ -0,0 +1,389 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"email-manager/internal/gmail"
+
+	gmailapi "google.golang.org/api/gmail/v1"
+)
+
+// browseHelp is the key summary shown on the first line of the browser.
+const browseHelp = "↑/↓ move  enter read  a archive  d trash  r read  u unread  q quit"
+
+// browser is the state of the browse command: the messages loaded so far,
+// the token of the next page and the position of the cursor.
+type browser struct {
+	service  *gmailapi.Service
+	query    string
+	pageSize int64
+	messages []*gmailapi.Message
+	nextPage string
+	loaded   bool
+	cursor   int
+	top      int
+	status   string
+}
+
+// run takes over the terminal until the user quits, restoring it on return.
+func (b *browser) run() error {
+	if err := b.loadPage(); err != nil {
+		return err
+	}
+
+	restore, err := rawTerminal()
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	for {
+		b.render()
+		key, err := readKey()
+		if err != nil {
+			return err
+		}
+
+		switch key {
+		case "q", "ctrl-c":
+			return nil
+		case "up", "k":
+			b.move(-1)
+		case "down", "j":
+			b.move(1)
+		case "pgup":
+			b.move(-b.visibleRows())
+		case "pgdown", " ":
+			b.move(b.visibleRows())
+		case "enter":
+			if len(b.messages) > 0 {
+				if err := b.read(); err != nil {
+					b.status = err.Error()
+				}
+			}
+		case "a", "d", "r", "u":
+			if len(b.messages) > 0 {
+				b.act(key)
+			}
+		}
+	}
+}
+
+// loadPage appends the next page of messages, fetching their headers.
+func (b *browser) loadPage() error {
+	call := b.service.Users.Messages.List(gmail.UserID).MaxResults(b.pageSize)
+	if b.query != "" {
+		call = call.Q(b.query)
+	}
+	if b.nextPage != "" {
+		call = call.PageToken(b.nextPage)
+	}
+	response, err := call.Do()
+	if err != nil {
+		return fmt.Errorf("error listing messages: %w", err)
+	}
+	b.nextPage = response.NextPageToken
+	b.loaded = true
+
+	ids := make([]string, len(response.Messages))
+	for i, msg := range response.Messages {
+		ids[i] = msg.Id
+	}
+	return gmail.FetchMessages(b.service, ids, "metadata", 8, func(id string, msg *gmailapi.Message, err error) error {
+		if err != nil {
+			// Deleted since it was listed
+			return nil
+		}
+		b.messages = append(b.messages, msg)
+		return nil
+	})
+}
+
+// move moves the cursor by delta rows, loading the next page when it goes
+// past the last loaded message.
+func (b *browser) move(delta int) {
+	b.cursor += delta
+	if b.cursor >= len(b.messages) && b.nextPage != "" {
+		b.status = "Loading..."
+		b.render()
+		if err := b.loadPage(); err != nil {
+			b.status = err.Error()
+			return
+		}
+		b.status = ""
+	}
+	b.cursor = max(min(b.cursor, len(b.messages)-1), 0)
+}
+
+// act applies the action of key to the message under the cursor, through
+// the same label changes as the archive, delete, read and unread commands.
+func (b *browser) act(key string) {
+	msg := b.messages[b.cursor]
+	var err error
+	switch key {
+	case "a":
+		err = gmail.ModifyLabels(b.service, []string{msg.Id}, nil, []string{"INBOX"})
+		if err == nil {
+			b.remove("Archived")
+		}
+	case "d":
+		_, err = b.service.Users.Messages.Trash(gmail.UserID, msg.Id).Do()
+		if err == nil {
+			b.remove("Moved to trash")
+		}
+	case "r":
+		err = gmail.ModifyLabels(b.service, []string{msg.Id}, nil, []string{"UNREAD"})
+		if err == nil {
+			msg.LabelIds = removeLabel(msg.LabelIds, "UNREAD")
+			b.status = "Marked as read"
+		}
+	case "u":
+		err = gmail.ModifyLabels(b.service, []string{msg.Id}, []string{"UNREAD"}, nil)
+		if err == nil {
+			if !slices.Contains(msg.LabelIds, "UNREAD") {
+				msg.LabelIds = append(msg.LabelIds, "UNREAD")
+			}
+			b.status = "Marked as unread"
+		}
+	}
+	if err != nil {
+		b.status = err.Error()
+	}
+}
+
+// remove drops the message under the cursor from the list.
+func (b *browser) remove(status string) {
+	b.messages = append(b.messages[:b.cursor], b.messages[b.cursor+1:]...)
+	b.cursor = max(min(b.cursor, len(b.messages)-1), 0)
+	b.status = status
+}
+
+// read shows the message under the cursor in a pager, marking it read like
+// Gmail does when a message is opened.
+func (b *browser) read() error {
+	summary := b.messages[b.cursor]
+	msg, err := b.service.Users.Messages.Get(gmail.UserID, summary.Id).Do()
+	if err != nil {
+		return gmail.MessageError(summary.Id, err)
+	}
+	if slices.Contains(summary.LabelIds, "UNREAD") {
+		if err := gmail.ModifyLabels(b.service, []string{msg.Id}, nil, []string{"UNREAD"}); err == nil {
+			summary.LabelIds = removeLabel(summary.LabelIds, "UNREAD")
+		}
+	}
+
+	var lines []string
+	for _, name := range []string{"From", "To", "Cc", "Subject", "Date"} {
+		for _, header := range gmail.MessageHeaders(msg) {
+			if header.Name == name {
+				lines = append(lines, header.Name+": "+gmail.SanitizeText(header.Value))
+			}
+		}
+	}
+	lines = append(lines, "")
+	body := gmail.GetBody(msg.Payload)
+	if html := gmail.GetHTMLBody(msg.Payload); html != "" && body == "[No text content]" {
+		body = gmail.HTMLToText(html)
+	}
+	lines = append(lines, strings.Split(gmail.SanitizeText(strings.ReplaceAll(body, "\r\n", "\n")), "\n")...)
+
+	rows, cols := terminalSize()
+	lines = wrapLines(lines, cols)
+	offset := 0
+	for {
+		fmt.Print("\033[H\033[2J")
+		fmt.Printf("\033[7m%s\033[0m\r\n", padLine("↑/↓ scroll  space page  a archive  d trash  u unread  q back", cols))
+		end := min(offset+rows-1, len(lines))
+		for _, line := range lines[offset:end] {
+			fmt.Print(line + "\r\n")
+		}
+
+		key, err := readKey()
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "q", "esc", "ctrl-c":
+			return nil
+		case "up", "k":
+			offset = max(offset-1, 0)
+		case "down", "j", "enter":
+			offset = max(min(offset+1, len(lines)-rows+1), 0)
+		case "pgup", "b":
+			offset = max(offset-(rows-1), 0)
+		case "pgdown", " ":
+			offset = max(min(offset+rows-1, len(lines)-rows+1), 0)
+		case "a", "d", "u":
+			b.act(key)
+			return nil
+		}
+	}
+}
+
+// render draws the message list, keeping the cursor on screen.
+func (b *browser) render() {
+	rows, cols := terminalSize()
+	visible := b.visibleRows()
+	if b.cursor < b.top {
+		b.top = b.cursor
+	}
+	if b.cursor >= b.top+visible {
+		b.top = b.cursor - visible + 1
+	}
+
+	fmt.Print("\033[H\033[2J")
+	fmt.Printf("\033[7m%s\033[0m\r\n", padLine(browseHelp, cols))
+	if len(b.messages) == 0 && b.loaded {
+		fmt.Print("No messages\r\n")
+	}
+	for i := b.top; i < min(b.top+visible, len(b.messages)); i++ {
+		line := b.formatRow(b.messages[i], cols)
+		switch {
+		case i == b.cursor:
+			fmt.Printf("\033[7m%s\033[0m\r\n", line)
+		case slices.Contains(b.messages[i].LabelIds, "UNREAD"):
+			fmt.Printf("\033[1m%s\033[0m\r\n", line)
+		default:
+			fmt.Print(line + "\r\n")
+		}
+	}
+
+	status := fmt.Sprintf("%d message(s)", len(b.messages))
+	if b.nextPage != "" {
+		status += ", more below"
+	}
+	if b.status != "" {
+		status += " | " + b.status
+	}
+	fmt.Printf("\033[%d;1H%s", rows, gmail.Truncate(status, cols))
+	b.status = ""
+}
+
+// formatRow formats a message as a list row: date, sender and subject.
+func (b *browser) formatRow(msg *gmailapi.Message, cols int) string {
+	subject, from := gmail.ExtractHeaders(gmail.MessageHeaders(msg))
+	if name, _, ok := strings.Cut(from, " <"); ok && name != "" {
+		from = strings.Trim(name, `"`)
+	}
+
+	received := time.UnixMilli(msg.InternalDate)
+	date := received.Format("Jan 02")
+	if now := time.Now(); received.Year() == now.Year() && received.YearDay() == now.YearDay() {
+		date = received.Format("15:04")
+	}
+
+	from = padLine(gmail.Truncate(gmail.SanitizeText(from), 24), 24)
+	line := fmt.Sprintf(" %-6s  %s  %s", date, from, gmail.SanitizeText(subject))
+	return padLine(gmail.Truncate(line, cols), cols)
+}
+
+// visibleRows returns the number of list rows that fit on screen.
+func (b *browser) visibleRows() int {
+	rows, _ := terminalSize()
+	return max(rows-2, 1)
+}
+
+// rawTerminal switches the terminal to unbuffered input without echo on the
+// alternate screen, returning a function that restores it.
+func rawTerminal() (func(), error) {
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, fmt.Errorf("error reading terminal settings: %w", err)
+	}
+	if _, err := stty("-icanon", "-echo", "-isig", "min", "1"); err != nil {
+		return nil, fmt.Errorf("error setting up terminal: %w", err)
+	}
+	fmt.Print("\033[?1049h\033[?25l")
+	return func() {
+		fmt.Print("\033[?25h\033[?1049l")
+		stty(strings.TrimSpace(saved))
+	}, nil
+}
+
+// stty runs stty on the terminal and returns its output.
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return string(out), err
+}
+
+// terminalSize returns the number of rows and columns of the terminal,
+// defaulting to 24x80.
+func terminalSize() (rows, cols int) {
+	out, err := stty("size")
+	if err != nil {
+		return 24, 80
+	}
+	if _, err := fmt.Sscan(out, &rows, &cols); err != nil || rows <= 0 || cols <= 0 {
+		return 24, 80
+	}
+	return rows, cols
+}
+
+// readKey reads one key press, naming the special keys the browser uses.
+func readKey() (string, error) {
+	var buf [16]byte
+	n, err := os.Stdin.Read(buf[:])
+	if err != nil {
+		return "", err
+	}
+	switch key := string(buf[:n]); key {
+	case "\033[A", "\033OA":
+		return "up", nil
+	case "\033[B", "\033OB":
+		return "down", nil
+	case "\033[5~":
+		return "pgup", nil
+	case "\033[6~":
+		return "pgdown", nil
+	case "\r", "\n":
+		return "enter", nil
+	case "\033":
+		return "esc", nil
+	case "\x03":
+		return "ctrl-c", nil
+	default:
+		return key, nil
+	}
+}
+
+// padLine pads s with spaces to width characters.
+func padLine(s string, width int) string {
+	if n := utf8.RuneCountInString(s); n < width {
+		return s + strings.Repeat(" ", width-n)
+	}
+	return s
+}
+
+// wrapLines hard-wraps lines longer than width characters.
+func wrapLines(lines []string, width int) []string {
+	var wrapped []string
+	for _, line := range lines {
+		line = strings.ReplaceAll(line, "\t", "    ")
+		runes := []rune(line)
+		for len(runes) > width {
+			wrapped = append(wrapped, string(runes[:width]))
+			runes = runes[width:]
+		}
+		wrapped = append(wrapped, string(runes))
+	}
+	return wrapped
+}
+
+// removeLabel returns labels without id.
+func removeLabel(labels []string, id string) []string {
+	var kept []string
+	for _, label := range labels {
+		if label != id {
+			kept = append(kept, label)
+		}
+	}
+	return kept
+}
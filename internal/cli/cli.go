@@ -2,17 +2,38 @@
 package cli
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
 	"context"
-	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
 	"strings"
+	"syscall"
+	"text/tabwriter"
+	"text/template"
+	"time"
+	"unicode/utf8"
 
 	"email-manager/internal/gmail"
+	"email-manager/pkg/auth"
 
 	"github.com/fatih/color"
+	"github.com/mattn/go-isatty"
 	"github.com/spf13/cobra"
 	gmailapi "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
 )
 
 // Color functions
@@ -22,24 +43,211 @@ var (
 	red   = color.New(color.FgRed).SprintFunc()
 )
 
+// ErrNoMessages is returned by list and search with --exit-code when nothing
+// matches. It is reported through the exit status only.
+var ErrNoMessages = errors.New("no messages found")
+
+// Exit codes returned by ExitCode, so scripts can branch on the error class.
+const (
+	ExitError       = 1
+	ExitUsage       = 2
+	ExitAuth        = 3
+	ExitNotFound    = 4
+	ExitRateLimited = 5
+	ExitNetwork     = 6
+)
+
+// usageError marks an error cobra returned before running a command, such
+// as an unknown flag or a wrong number of arguments, or an invalid flag value
+// found by a handler.
+type usageError struct {
+	err error
+}
+
+func (e usageError) Error() string { return e.err.Error() }
+func (e usageError) Unwrap() error { return e.err }
+
+// defaultMaxResults is the number of messages list shows for --max 0.
+const defaultMaxResults = 10
+
+// bulkSampleSize is the number of messages purge and cleanup-sender show
+// before acting.
+const bulkSampleSize = 5
+
+// handlerRan is set once a command handler starts, so Execute can tell usage
+// errors from handler errors.
+var handlerRan bool
+
+// rerun runs the last started handler again with the same arguments, for
+// Execute to retry after authorizing again.
+var rerun func() error
+
 // Command line flags
 var (
-	attach      []string
-	bcc         string
-	body        string
-	cc          string
-	downloadDir string
-	maxResults  int64
-	query       string
-	subject     string
-	to          string
+	addLabels             []string
+	allPages              bool
+	assumeYes             bool
+	attach                []string
+	attachURLs            []string
+	authResults           bool
+	bcc                   []string
+	body                  string
+	browsePageSize        int64
+	browseQuery           string
+	cc                    []string
+	concurrency           int
+	confirmThreshold      int
+	contactsScan          int64
+	dedupeThreads         bool
+	downloadDir           string
+	dryRun                bool
+	execHook              string
+	exitCode              bool
+	filterArchive         bool
+	forceSend             bool
+	from                  string
+	fullFetch             bool
+	getAttachments        bool
+	getConversation       bool
+	getFields             []string
+	getHTML               bool
+	hasAttachment         bool
+	historyLabel          string
+	icsFile               string
+	includePatterns       []string
+	inReplyTo             string
+	isUnread              bool
+	jsonErrors            bool
+	keepInbox             bool
+	labelColor            string
+	labelCounts           bool
+	labelType             string
+	labelListVisibility   string
+	largerThan            string
+	listLabels            []string
+	listScheduled         bool
+	markRead              bool
+	maxBytes              int
+	maxResults            int64
+	messageFormat         string
+	messageListVisibility string
+	newerThan             string
+	noReauth              bool
+	noThread              bool
+	olderThan             string
+	openURL               bool
+	outputFormat          string
+	outputTemplate        string
+	permanentDelete       bool
+	pollInterval          time.Duration
+	preserveStructure     bool
+	priority              string
+	purgeQuery            string
+	query                 string
+	quiet                 bool
+	rawBody               bool
+	recipientsFile        string
+	references            string
+	removeLabels          []string
+	refreshContacts       bool
+	renderHTML            bool
+	replyTo               string
+	savePath              string
+	savedSearch           string
+	scheduleAt            string
+	sendDelay             time.Duration
+	signatureFile         string
+	sinceID               string
+	snippetWidth          int
+	sortKey               string
+	startHistoryID        uint64
+	statusStyle           string
+	subject               string
+	syncSinceID           uint64
+	threadID              string
+	threadMode            bool
+	to                    string
+	toStdout              bool
+	trackingPixel         string
+	trashExisting         bool
+	utcTimes              bool
+	verbose               bool
+	vacationEnd           string
+	vacationStart         string
+	watchMax              int64
+	watchQuery            string
+	withAttachments       bool
+	wrapWidth             int
 )
 
-// RootCmd is the root command for the CLI.
+// RootCmd is the root command for the CLI. Errors are not printed by cobra:
+// Execute returns them to main.
 var RootCmd = &cobra.Command{
-	Use:   "email-manager",
-	Short: "Gmail Manager - Manage Gmail emails",
-	Long:  "Send, receive, search, and manage Gmail emails using Gmail API v1",
+	Use:           "email-manager",
+	Short:         "Gmail Manager - Manage Gmail emails",
+	Long:          "Send, receive, search, and manage Gmail emails using Gmail API v1",
+	SilenceErrors: true,
+}
+
+// Execute runs the root command and returns its error, classified with the
+// gmail error types (ErrNotAuthenticated, ErrNotFound, ErrRateLimited,
+// ErrNetwork). Errors returned before a handler ran are usage errors.
+func Execute() error {
+	err := RootCmd.Execute()
+	if err != nil && !handlerRan {
+		return usageError{err}
+	}
+	err = gmail.ClassifyError(err)
+	if errors.Is(err, gmail.ErrNotAuthenticated) && canReauthorize() && auth.RemoveSavedToken() {
+		fmt.Fprintf(os.Stderr, "Warning: the saved token was rejected (revoked or expired), authorizing again: %v\n", err)
+		err = gmail.ClassifyError(rerun())
+	}
+	return err
+}
+
+// canReauthorize reports whether a command that failed on a rejected token
+// can be retried after a new authorization: only when nothing went through
+// yet, so that no action is repeated, and with a user at the terminal to
+// complete the authorization.
+func canReauthorize() bool {
+	return !noReauth && rerun != nil && !gmail.RequestAccepted() && isatty.IsTerminal(os.Stdin.Fd())
+}
+
+// ExitCode returns the exit status for an error returned by Execute: ExitUsage,
+// ExitAuth, ExitNotFound, ExitRateLimited, ExitNetwork, or ExitError for any
+// other failure.
+func ExitCode(err error) int {
+	var usage usageError
+	switch {
+	case errors.As(err, &usage):
+		return ExitUsage
+	case errors.Is(err, gmail.ErrNotAuthenticated), errors.Is(err, gmail.ErrInsufficientScope):
+		return ExitAuth
+	case errors.Is(err, gmail.ErrNotFound), errors.Is(err, gmail.ErrMessageNotFound), errors.Is(err, gmail.ErrLabelNotFound):
+		return ExitNotFound
+	case errors.Is(err, gmail.ErrRateLimited):
+		return ExitRateLimited
+	case errors.Is(err, gmail.ErrNetwork):
+		return ExitNetwork
+	}
+	return ExitError
+}
+
+// PrintError reports an error returned by Execute on stderr, as plain text
+// or, with --json-errors, as a {"error": ..., "code": ...} object.
+func PrintError(err error) {
+	if !jsonErrors {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	code := gmail.ErrorCode(err)
+	if errors.As(err, new(usageError)) {
+		code = "usage_error"
+	}
+	json.NewEncoder(os.Stderr).Encode(map[string]string{
+		"error": err.Error(),
+		"code":  code,
+	})
 }
 
 // Command definitions
@@ -52,12 +260,42 @@ var (
 	}
 
 	archiveCmd = &cobra.Command{
-		Use:   "archive <message-id>",
-		Short: "Archive a message",
-		Args:  cobra.ExactArgs(1),
+		Use:   "archive <message-id>...",
+		Short: "Archive messages",
+		Args:  cobra.MinimumNArgs(1),
 		RunE:  runArchive,
 	}
 
+	browseCmd = &cobra.Command{
+		Use:   "browse",
+		Short: "Browse messages interactively in the terminal",
+		Args:  cobra.NoArgs,
+		RunE:  runBrowse,
+	}
+
+	cleanupSenderCmd = &cobra.Command{
+		Use:   "cleanup-sender <email-address>",
+		Short: "Trash every message from a sender",
+		Long:  "Find all the messages from a sender and move them to the trash after confirmation, a one-time cleanup where mute --trash-existing also filters future mail",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runCleanupSender,
+	}
+
+	contactsCmd = &cobra.Command{
+		Use:   "contacts",
+		Short: "List the addresses you send mail to, most frequent first",
+		Long:  "List the recipients of your recent sent messages, most frequent first; the result is cached for a day and used to complete --to, --cc and --bcc",
+		Args:  cobra.NoArgs,
+		RunE:  runContacts,
+	}
+
+	createFilterCmd = &cobra.Command{
+		Use:   "create",
+		Short: "Create a filter",
+		Args:  cobra.NoArgs,
+		RunE:  runCreateFilter,
+	}
+
 	createLabelCmd = &cobra.Command{
 		Use:   "create <name>",
 		Short: "Create a label",
@@ -72,6 +310,20 @@ var (
 		RunE:  runDelete,
 	}
 
+	deleteFilterCmd = &cobra.Command{
+		Use:   "delete <filter-id>",
+		Short: "Delete a filter",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runDeleteFilter,
+	}
+
+	diffCmd = &cobra.Command{
+		Use:   "diff <message-id-1> <message-id-2>",
+		Short: "Show a unified diff of the headers and bodies of two messages",
+		Args:  cobra.ExactArgs(2),
+		RunE:  runDiff,
+	}
+
 	downloadAttachmentsCmd = &cobra.Command{
 		Use:   "download-attachments <message-id>",
 		Short: "Download attachments from a message",
@@ -79,13 +331,49 @@ var (
 		RunE:  runDownloadAttachments,
 	}
 
+	filtersCmd = &cobra.Command{
+		Use:   "filters",
+		Short: "Manage filters",
+	}
+
 	getCmd = &cobra.Command{
-		Use:   "get <message-id>",
-		Short: "Get a message by ID",
+		Use:   "get <message-id | ->",
+		Short: "Get a message by ID, or messages with IDs from stdin as JSON Lines",
 		Args:  cobra.ExactArgs(1),
 		RunE:  runGet,
 	}
 
+	historyCmd = &cobra.Command{
+		Use:   "history",
+		Short: "Show mailbox changes since a history ID",
+		Long:  "List messages added, deleted or relabeled since a history ID, for incremental syncing",
+		Args:  cobra.NoArgs,
+		RunE:  runHistory,
+	}
+
+	importCmd = &cobra.Command{
+		Use:   "import <file.eml>",
+		Short: "Import an .eml file as a new message",
+		Long:  "Import a raw RFC 822 message into the mailbox without sending it, e.g. to migrate archived mail",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runImport,
+	}
+
+	importantCmd = &cobra.Command{
+		Use:   "important <message-id>...",
+		Short: "Mark messages as important",
+		Args:  cobra.MinimumNArgs(1),
+		RunE:  runImportant,
+	}
+
+	insertCmd = &cobra.Command{
+		Use:   "insert <file.eml>",
+		Short: "Insert an .eml file without delivery processing",
+		Long:  "Insert a raw RFC 822 message into the mailbox as is, bypassing spam classification and threading, e.g. to seed a test mailbox",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runInsert,
+	}
+
 	labelsCmd = &cobra.Command{
 		Use:   "labels",
 		Short: "Manage labels",
@@ -97,23 +385,91 @@ var (
 		RunE:  runList,
 	}
 
+	listFiltersCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List all filters",
+		Args:  cobra.NoArgs,
+		RunE:  runListFilters,
+	}
+
 	listLabelsCmd = &cobra.Command{
 		Use:   "list",
 		Short: "List all labels",
 		RunE:  runListLabels,
 	}
 
-	readCmd = &cobra.Command{
-		Use:   "read <message-id>",
-		Short: "Mark message as read",
+	modifyCmd = &cobra.Command{
+		Use:   "modify <message-id>...",
+		Short: "Add and remove labels on messages",
+		Long:  "Add and remove labels (names or IDs) on one or more messages in a single request",
+		Args:  cobra.MinimumNArgs(1),
+		RunE:  runModify,
+	}
+
+	moveCmd = &cobra.Command{
+		Use:   "move <message-id>... <label>",
+		Short: "Move messages to a label",
+		Long:  "Add a label to one or more messages and remove them from the inbox in a single request",
+		Args:  cobra.MinimumNArgs(2),
+		RunE:  runMove,
+	}
+
+	muteCmd = &cobra.Command{
+		Use:   "mute <email-address>",
+		Short: "Mute a sender",
+		Long:  "Create a filter that marks mail from a sender as read and skips the inbox",
 		Args:  cobra.ExactArgs(1),
+		RunE:  runMute,
+	}
+
+	notImportantCmd = &cobra.Command{
+		Use:   "not-important <message-id>...",
+		Short: "Mark messages as not important",
+		Args:  cobra.MinimumNArgs(1),
+		RunE:  runNotImportant,
+	}
+
+	purgeCmd = &cobra.Command{
+		Use:   "purge",
+		Short: "Trash messages older than an age",
+		Long:  "Find the messages matching a query that are older than --older-than and move them to the trash (or delete them with --permanent). Without --yes only the count and a sample are shown.",
+		Args:  cobra.NoArgs,
+		RunE:  runPurge,
+	}
+
+	readCmd = &cobra.Command{
+		Use:   "read <message-id>...",
+		Short: "Mark messages as read",
+		Args:  cobra.MinimumNArgs(1),
 		RunE:  runRead,
 	}
 
+	replyAllCmd = &cobra.Command{
+		Use:   "reply-all <message-id>",
+		Short: "Reply to the sender and all recipients of a message",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runReplyAll,
+	}
+
+	replyCmd = &cobra.Command{
+		Use:   "reply <message-id>",
+		Short: "Reply to the sender of a message",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runReply,
+	}
+
+	resendCmd = &cobra.Command{
+		Use:   "resend <message-id>",
+		Short: "Send a sent message again",
+		Long:  "Send a message from the Sent folder again as a new message, with a fresh Date and Message-ID, optionally to other recipients",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runResend,
+	}
+
 	searchCmd = &cobra.Command{
-		Use:   "search <query>",
+		Use:   "search [query | -]",
 		Short: "Search messages",
-		Args:  cobra.ExactArgs(1),
+		Args:  cobra.MaximumNArgs(1),
 		RunE:  runSearch,
 	}
 
@@ -123,43 +479,360 @@ var (
 		RunE:  runSend,
 	}
 
+	sendScheduledCmd = &cobra.Command{
+		Use:   "send-scheduled",
+		Short: "Send scheduled emails that are due (run from cron)",
+		Args:  cobra.NoArgs,
+		RunE:  runSendScheduled,
+	}
+
+	syncCmd = &cobra.Command{
+		Use:   "sync",
+		Short: "Download the attachments of messages added since the last sync",
+		Long:  "Download the attachments of messages added since a history ID (default the one stored by the last run), then store the latest history ID for the next run",
+		Args:  cobra.NoArgs,
+		RunE:  runSync,
+	}
+
+	trashCmd = &cobra.Command{
+		Use:   "trash",
+		Short: "Manage the trash",
+	}
+
+	trashEmptyCmd = &cobra.Command{
+		Use:   "empty",
+		Short: "Permanently delete every message in the trash",
+		Args:  cobra.NoArgs,
+		RunE:  runTrashEmpty,
+	}
+
+	trashListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List messages in the trash",
+		Args:  cobra.NoArgs,
+		RunE:  runTrashList,
+	}
+
 	unreadCmd = &cobra.Command{
-		Use:   "unread <message-id>",
-		Short: "Mark message as unread",
-		Args:  cobra.ExactArgs(1),
+		Use:   "unread <message-id>...",
+		Short: "Mark messages as unread",
+		Args:  cobra.MinimumNArgs(1),
 		RunE:  runUnread,
 	}
+
+	unsubscribeCmd = &cobra.Command{
+		Use:   "unsubscribe <message-id>",
+		Short: "Unsubscribe from a mailing list",
+		Long:  "Unsubscribe with the List-Unsubscribe header of a message: a one-click POST when List-Unsubscribe-Post allows it, else an email to its mailto: address, else the web page is printed (and opened with --open)",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runUnsubscribe,
+	}
+
+	untrashCmd = &cobra.Command{
+		Use:   "untrash <message-id>",
+		Short: "Restore a message from the trash",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runUntrash,
+	}
+
+	vacationCmd = &cobra.Command{
+		Use:   "vacation",
+		Short: "Manage the vacation auto-responder",
+	}
+
+	vacationOffCmd = &cobra.Command{
+		Use:   "off",
+		Short: "Disable the vacation auto-responder",
+		Args:  cobra.NoArgs,
+		RunE:  runVacationOff,
+	}
+
+	vacationSetCmd = &cobra.Command{
+		Use:   "set",
+		Short: "Enable the vacation auto-responder",
+		Args:  cobra.NoArgs,
+		RunE:  runVacationSet,
+	}
+
+	vacationStatusCmd = &cobra.Command{
+		Use:   "status",
+		Short: "Show the vacation auto-responder settings",
+		Args:  cobra.NoArgs,
+		RunE:  runVacationStatus,
+	}
+
+	watchCmd = &cobra.Command{
+		Use:   "watch",
+		Short: "Watch for new messages",
+		Long:  "Poll for messages matching a query and print each new one as it arrives",
+		RunE:  runWatch,
+	}
 )
 
 // Init initializes the CLI commands and flags.
 func Init() {
 	// Setup command flags
+	setupRootFlags()
+	setupArchiveFlags()
+	setupBrowseFlags()
+	setupCleanupSenderFlags()
+	setupContactsFlags()
 	setupSendFlags()
 	setupListFlags()
 	setupSearchFlags()
+	setupSendScheduledFlags()
+	setupDeleteFlags()
+	setupDiffFlags()
 	setupDownloadAttachmentsFlags()
+	setupFilterCommands()
+	setupGetFlags()
+	setupHistoryFlags()
+	setupImportFlags()
+	setupInsertFlags()
 	setupLabelCommands()
+	setupModifyFlags()
+	setupMoveFlags()
+	setupMuteFlags()
+	setupPurgeFlags()
+	setupReplyFlags()
+	setupResendFlags()
+	setupSyncFlags()
+	setupTrashCommands()
+	setupUnsubscribeFlags()
+	setupVacationCommands()
+	setupWatchFlags()
+	setupScopes()
+	setupCompletions()
 
 	// Register all commands
 	RootCmd.AddCommand(sendCmd)
+	RootCmd.AddCommand(sendScheduledCmd)
 	RootCmd.AddCommand(listCmd)
 	RootCmd.AddCommand(getCmd)
+	RootCmd.AddCommand(replyCmd)
+	RootCmd.AddCommand(replyAllCmd)
+	RootCmd.AddCommand(resendCmd)
 	RootCmd.AddCommand(searchCmd)
 	RootCmd.AddCommand(readCmd)
 	RootCmd.AddCommand(unreadCmd)
 	RootCmd.AddCommand(archiveCmd)
+	RootCmd.AddCommand(importantCmd)
+	RootCmd.AddCommand(notImportantCmd)
+	RootCmd.AddCommand(modifyCmd)
+	RootCmd.AddCommand(moveCmd)
+	RootCmd.AddCommand(muteCmd)
 	RootCmd.AddCommand(deleteCmd)
+	RootCmd.AddCommand(purgeCmd)
+	RootCmd.AddCommand(cleanupSenderCmd)
+	RootCmd.AddCommand(untrashCmd)
+	RootCmd.AddCommand(unsubscribeCmd)
+	RootCmd.AddCommand(trashCmd)
 	RootCmd.AddCommand(downloadAttachmentsCmd)
 	RootCmd.AddCommand(labelsCmd)
+	RootCmd.AddCommand(filtersCmd)
+	RootCmd.AddCommand(vacationCmd)
+	RootCmd.AddCommand(watchCmd)
+	RootCmd.AddCommand(historyCmd)
+	RootCmd.AddCommand(syncCmd)
+	RootCmd.AddCommand(importCmd)
+	RootCmd.AddCommand(insertCmd)
+	RootCmd.AddCommand(browseCmd)
+	RootCmd.AddCommand(diffCmd)
+	RootCmd.AddCommand(contactsCmd)
+	markHandlers(RootCmd)
+}
+
+// markHandlers wraps the handler of cmd and of its subcommands to set
+// handlerRan and rerun when it starts.
+func markHandlers(cmd *cobra.Command) {
+	if run := cmd.RunE; run != nil {
+		cmd.RunE = func(cmd *cobra.Command, args []string) error {
+			handlerRan = true
+			rerun = func() error { return run(cmd, args) }
+			return run(cmd, args)
+		}
+	}
+	for _, sub := range cmd.Commands() {
+		markHandlers(sub)
+	}
 }
 
 // Setup functions
 
+func setupRootFlags() {
+	RootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Log API requests and timings to stderr")
+	RootCmd.PersistentFlags().BoolVarP(&quiet, "quiet", "q", false, "Hide progress output")
+	RootCmd.PersistentFlags().BoolVar(&jsonErrors, "json-errors", false, "Report errors on stderr as JSON objects with an error code")
+	RootCmd.PersistentFlags().BoolVar(&gmail.RefreshLabels, "refresh-labels", false, "Fetch the label list instead of using the cached one")
+	RootCmd.PersistentFlags().StringVar(&gmail.UserID, "user", "me", "Mailbox to act on, for delegated or shared mailboxes")
+	RootCmd.PersistentFlags().StringVar(&auth.ServiceAccountFile, "service-account", os.Getenv("EMAIL_MANAGER_SERVICE_ACCOUNT"), "Service account JSON key for domain-wide delegation (env EMAIL_MANAGER_SERVICE_ACCOUNT)")
+	RootCmd.PersistentFlags().StringVar(&auth.Impersonate, "impersonate", os.Getenv("EMAIL_MANAGER_IMPERSONATE"), "User to act as with --service-account (env EMAIL_MANAGER_IMPERSONATE)")
+	RootCmd.PersistentFlags().BoolVar(&auth.NoBrowser, "no-browser", false, "Authorize by pasting a code instead of opening a browser (SSH, headless)")
+	RootCmd.PersistentFlags().BoolVar(&noReauth, "no-reauth", false, "Fail instead of deleting a rejected token and authorizing again")
+	RootCmd.PersistentFlags().StringVar(&auth.ScopePreset, "scopes", cmp.Or(os.Getenv("EMAIL_MANAGER_SCOPES"), "full"), "Scopes requested when authorizing: readonly, modify (no permanent deletion) or full (env EMAIL_MANAGER_SCOPES)")
+	RootCmd.PersistentFlags().StringVar(&statusStyle, "status-style", cmp.Or(os.Getenv("EMAIL_MANAGER_STATUS_STYLE"), "plain"), "Confirmation messages: plain, emoji, ascii ([OK] prefix) or silent (env EMAIL_MANAGER_STATUS_STYLE)")
+
+	RootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		if err := validateStatusStyle(); err != nil {
+			return err
+		}
+		if err := validateScopesPreset(); err != nil {
+			return err
+		}
+		warnMissingScopes(cmd)
+		return nil
+	}
+
+	cobra.OnInitialize(func() {
+		if verbose {
+			gmail.EnableRequestLogging()
+			auth.Verbose = true
+		}
+		// Keep stderr parseable
+		if jsonErrors {
+			RootCmd.SilenceUsage = true
+		}
+	})
+	cobra.OnFinalize(gmail.PrintRequestSummary)
+}
+
+func setupArchiveFlags() {
+	archiveCmd.Flags().BoolVar(&markRead, "read", false, "Also mark the messages as read")
+}
+
+// setupBrowseFlags registers the query and page size of the browse command.
+func setupBrowseFlags() {
+	browseCmd.Flags().StringVar(&browseQuery, "query", "in:inbox", "Gmail query of the messages to browse")
+	browseCmd.Flags().Int64Var(&browsePageSize, "page-size", 50, "Messages loaded per page")
+}
+
+func setupCleanupSenderFlags() {
+	cleanupSenderCmd.Flags().BoolVarP(&assumeYes, "yes", "y", false, "Trash without asking for confirmation")
+}
+
+// setupCompletions registers dynamic completions for message IDs and labels.
+// The shell completion command itself is added by cobra.
+func setupCompletions() {
+	for _, cmd := range []*cobra.Command{archiveCmd, deleteCmd, downloadAttachmentsCmd, getCmd, importantCmd, modifyCmd, notImportantCmd, readCmd, replyAllCmd, replyCmd, unreadCmd, unsubscribeCmd, untrashCmd} {
+		cmd.ValidArgsFunction = completeMessageID
+	}
+
+	applyLabelCmd.ValidArgsFunction = func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if len(args) == 0 {
+			return completeMessageID(cmd, args, toComplete)
+		}
+		if len(args) == 1 {
+			return completeLabels(true)
+		}
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	moveCmd.ValidArgsFunction = func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if len(args) == 0 {
+			return completeMessageID(cmd, args, toComplete)
+		}
+		// Any further argument may be another message or the target label
+		return completeLabels(false)
+	}
+
+	completeLabelNames := func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return completeLabels(false)
+	}
+	listCmd.RegisterFlagCompletionFunc("label", completeLabelNames)
+	historyCmd.RegisterFlagCompletionFunc("label-id", completeLabelNames)
+	importCmd.RegisterFlagCompletionFunc("label-ids", completeLabelNames)
+	createFilterCmd.RegisterFlagCompletionFunc("add-label", completeLabelNames)
+	modifyCmd.RegisterFlagCompletionFunc("add", completeLabelNames)
+	modifyCmd.RegisterFlagCompletionFunc("remove", completeLabelNames)
+
+	for _, flag := range []string{"to", "cc", "bcc"} {
+		sendCmd.RegisterFlagCompletionFunc(flag, completeContacts)
+	}
+	listCmd.RegisterFlagCompletionFunc("saved", completeSavedSearches)
+	searchCmd.RegisterFlagCompletionFunc("saved", completeSavedSearches)
+}
+
+func setupContactsFlags() {
+	contactsCmd.Flags().Int64Var(&contactsScan, "scan", 500, "Number of recent sent messages scanned")
+	contactsCmd.Flags().BoolVar(&refreshContacts, "refresh", false, "Scan again instead of using the cached list")
+}
+
+func setupDeleteFlags() {
+	deleteCmd.Flags().BoolVar(&threadMode, "thread", false, "Treat the ID as a thread ID and trash the whole conversation")
+	untrashCmd.Flags().BoolVar(&threadMode, "thread", false, "Treat the ID as a thread ID and restore the whole conversation")
+}
+
+func setupDiffFlags() {
+	diffCmd.Flags().StringSliceVar(&getFields, "fields", []string{}, "Headers to compare, comma-separated (default all)")
+}
+
 func setupDownloadAttachmentsFlags() {
-	downloadAttachmentsCmd.Flags().StringVar(&downloadDir, "dir", "~/Downloads", "Download directory")
+	downloadAttachmentsCmd.Flags().StringVar(&downloadDir, "dir", "~/Downloads", "Download directory; {date}, {from} and {subject} are replaced from the message")
+	downloadAttachmentsCmd.Flags().StringSliceVar(&includePatterns, "include", []string{}, "Only download attachments whose filename matches a glob, e.g. '*.csv' (repeatable)")
+	downloadAttachmentsCmd.Flags().BoolVar(&toStdout, "stdout", false, "Write the single matching attachment to stdout instead of a file")
+	downloadAttachmentsCmd.Flags().IntVar(&concurrency, "concurrency", 4, "Number of attachments downloaded at once")
+	downloadAttachmentsCmd.Flags().BoolVar(&preserveStructure, "preserve-structure", false, "Recreate the MIME part hierarchy as subdirectories instead of saving every file in --dir")
+	downloadAttachmentsCmd.MarkFlagsMutuallyExclusive("preserve-structure", "stdout")
+	downloadAttachmentsCmd.MarkFlagsMutuallyExclusive("dir", "stdout")
+}
+
+func setupFilterCommands() {
+	createFilterCmd.Flags().StringVar(&from, "from", "", "Match sender")
+	createFilterCmd.Flags().StringVar(&to, "to", "", "Match recipient")
+	createFilterCmd.Flags().StringVar(&subject, "subject", "", "Match subject")
+	createFilterCmd.Flags().StringVar(&query, "query", "", "Match Gmail query string")
+	createFilterCmd.Flags().StringSliceVar(&addLabels, "add-label", []string{}, "Label name or ID to apply (repeatable)")
+	createFilterCmd.Flags().BoolVar(&filterArchive, "archive", false, "Skip the inbox")
+
+	filtersCmd.AddCommand(listFiltersCmd)
+	filtersCmd.AddCommand(createFilterCmd)
+	filtersCmd.AddCommand(deleteFilterCmd)
+}
+
+func setupGetFlags() {
+	getCmd.Flags().BoolVar(&getHTML, "html", false, "Show the HTML body instead of plain text")
+	getCmd.Flags().StringVar(&savePath, "save", "", "Save the body to a file instead of printing it (in a directory, named <YYYYMMDD>_<subject>_<shortid>)")
+	getCmd.Flags().BoolVar(&renderHTML, "render", false, "Render the HTML body as plain text")
+	getCmd.Flags().StringSliceVar(&getFields, "fields", []string{}, "Headers to print, comma-separated (default From,To,Subject,Date)")
+	getCmd.Flags().BoolVar(&utcTimes, "utc", false, "Show the received date in UTC instead of local time")
+	getCmd.Flags().StringVar(&outputFormat, "output", "text", "Output format: text or markdown")
+	getCmd.Flags().StringVar(&messageFormat, "format", "full", "Message format fetched: full, metadata (headers only), minimal (IDs and labels) or raw (RFC 822 source)")
+	getCmd.Flags().StringVar(&outputTemplate, "template", "", "Go template for the message, or @file (e.g. '{{.From}}: {{.Body}}')")
+	getCmd.MarkFlagsMutuallyExclusive("template", "output")
+	getCmd.Flags().BoolVar(&getAttachments, "download-attachments", false, "Also download the message attachments")
+	getCmd.Flags().StringVar(&downloadDir, "dir", "~/Downloads", "Download directory for --download-attachments ({date}, {from} and {subject} are replaced)")
+	getCmd.Flags().BoolVar(&rawBody, "raw-body", false, "Print the body exactly as decoded, without escaping control characters")
+	getCmd.Flags().IntVar(&maxBytes, "max-bytes", 1<<20, "Truncate the printed body after this many bytes (0 for no limit; --save and --format raw are never truncated)")
+	getCmd.Flags().BoolVar(&authResults, "auth-results", false, "Show the SPF, DKIM and DMARC results, to spot spoofed senders")
+	getCmd.Flags().BoolVar(&getConversation, "conversation", false, "Show every message in the message's thread")
+	getCmd.Flags().IntVar(&concurrency, "concurrency", 4, "Number of messages fetched at once with -, and of attachments downloaded at once")
+	getCmd.MarkFlagsMutuallyExclusive("conversation", "save")
+	getCmd.MarkFlagsMutuallyExclusive("html", "render")
+	getCmd.MarkFlagsMutuallyExclusive("html", "output")
+}
+
+func setupHistoryFlags() {
+	historyCmd.Flags().Uint64Var(&startHistoryID, "start-id", 0, "History ID to list changes from (required)")
+	historyCmd.Flags().StringVar(&historyLabel, "label-id", "", "Only show changes to messages with this label (name or ID)")
+	historyCmd.MarkFlagRequired("start-id")
+}
+
+func setupImportFlags() {
+	importCmd.Flags().StringSliceVar(&addLabels, "label-ids", []string{}, "Label names or IDs to apply (e.g. INBOX,UNREAD)")
+}
+
+func setupInsertFlags() {
+	insertCmd.Flags().StringSliceVar(&addLabels, "label-ids", []string{}, "Label names or IDs to apply (e.g. INBOX,UNREAD)")
 }
 
 func setupLabelCommands() {
+	createLabelCmd.Flags().StringVar(&labelColor, "color", "", "Background and text colors as \"#rrggbb,#rrggbb\"")
+	createLabelCmd.Flags().StringVar(&labelListVisibility, "label-list-visibility", "", "Label list visibility (labelShow, labelShowIfUnread, labelHide)")
+	createLabelCmd.Flags().StringVar(&messageListVisibility, "message-list-visibility", "", "Message list visibility (show, hide)")
+
+	listLabelsCmd.Flags().BoolVar(&labelCounts, "counts", false, "Show message and thread counts (one extra request per label)")
+	listLabelsCmd.Flags().StringVar(&labelType, "type", "", "Only show system or user labels")
+
 	labelsCmd.AddCommand(listLabelsCmd)
 	labelsCmd.AddCommand(createLabelCmd)
 	labelsCmd.AddCommand(applyLabelCmd)
@@ -168,24 +841,162 @@ func setupLabelCommands() {
 func setupListFlags() {
 	listCmd.Flags().StringVar(&query, "query", "", "Gmail query string")
 	listCmd.Flags().Int64Var(&maxResults, "max", 10, "Maximum results")
+	listCmd.Flags().StringSliceVar(&listLabels, "label", []string{}, "Only list messages with this label name or ID (repeatable)")
+	listCmd.Flags().IntVar(&snippetWidth, "snippet-width", 80, "Snippet width in characters (0 to hide)")
+	listCmd.Flags().BoolVar(&fullFetch, "full", false, "Fetch full messages instead of headers only")
+	listCmd.Flags().StringVar(&sinceID, "since", "", "Only list messages newer than this message ID")
+	listCmd.Flags().BoolVar(&utcTimes, "utc", false, "Show dates in UTC instead of local time")
+	listCmd.Flags().StringVar(&outputTemplate, "template", "", "Go template for each message, or @file (e.g. '{{.Received}} {{.From}} {{.Subject}}')")
+	listCmd.Flags().BoolVar(&dedupeThreads, "dedupe", false, "Show only the most recent message of each thread")
+	listCmd.Flags().BoolVar(&withAttachments, "with-attachments", false, "Only messages with attachments other than inline images, showing their filenames")
+	addQueryFlags(listCmd)
+	listCmd.Flags().BoolVar(&exitCode, "exit-code", false, "Exit with status 1 when no messages match")
+}
+
+// addQueryFlags adds the structured search flags assembled by buildQuery.
+func addQueryFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&from, "from", "", "Only messages from this sender")
+	cmd.Flags().StringVar(&to, "to", "", "Only messages to this recipient")
+	cmd.Flags().StringVar(&subject, "subject", "", "Only messages whose subject contains this text")
+	cmd.Flags().BoolVar(&hasAttachment, "has-attachment", false, "Only messages with attachments")
+	cmd.Flags().BoolVar(&isUnread, "is-unread", false, "Only unread messages")
+	cmd.Flags().StringVar(&largerThan, "larger-than", "", "Only messages larger than this size (e.g. 5M, 100K)")
+	cmd.Flags().StringVar(&newerThan, "newer-than", "", "Only messages newer than this age (e.g. 7d, 2m, 1y)")
+	cmd.Flags().StringVar(&savedSearch, "saved", "", "Use a query saved in searches.conf under this name")
+}
+
+func setupModifyFlags() {
+	modifyCmd.Flags().StringSliceVar(&addLabels, "add", []string{}, "Label name or ID to add (repeatable)")
+	modifyCmd.Flags().StringSliceVar(&removeLabels, "remove", []string{}, "Label name or ID to remove (repeatable)")
+}
+
+func setupMoveFlags() {
+	moveCmd.Flags().BoolVar(&keepInbox, "keep-inbox", false, "Only add the label, keep messages in the inbox")
+}
+
+func setupMuteFlags() {
+	muteCmd.Flags().BoolVar(&trashExisting, "trash-existing", false, "Also move the sender's existing messages to the trash")
+}
+
+func setupPurgeFlags() {
+	purgeCmd.Flags().StringVar(&olderThan, "older-than", "", "Only messages older than this age (e.g. 90d, 6m, 1y) (required)")
+	purgeCmd.Flags().StringVar(&purgeQuery, "query", "", "Gmail query string the messages must also match")
+	purgeCmd.Flags().BoolVar(&permanentDelete, "permanent", false, "Delete permanently instead of moving to the trash")
+	purgeCmd.Flags().BoolVarP(&assumeYes, "yes", "y", false, "Act on the messages instead of only showing them")
+	purgeCmd.MarkFlagRequired("older-than")
+}
+
+func setupReplyFlags() {
+	for _, cmd := range []*cobra.Command{replyCmd, replyAllCmd} {
+		cmd.Flags().StringVar(&body, "body", "", "Reply body, written above the quoted message (required)")
+		cmd.Flags().StringSliceVar(&attach, "attach", []string{}, "Attachment file paths")
+		cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Print the reply instead of sending it")
+		cmd.Flags().BoolVar(&forceSend, "force", false, "Send even if an identical reply was sent in the last hour")
+		cmd.Flags().BoolVar(&noThread, "no-thread", false, "Start a new conversation instead of continuing the original one")
+		cmd.MarkFlagRequired("body")
+	}
+}
+
+func setupResendFlags() {
+	resendCmd.Flags().StringVar(&to, "to", "", "Send to these recipients instead of the original To, Cc and Bcc")
+	resendCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Print the message instead of sending it")
 }
 
 func setupSearchFlags() {
-	searchCmd.Flags().Int64Var(&maxResults, "max", 10, "Maximum results")
+	searchCmd.Flags().Int64Var(&maxResults, "max", 10, "Maximum results (0 to only print the number of matches)")
+	searchCmd.Flags().IntVar(&snippetWidth, "snippet-width", 80, "Snippet width in characters (0 to hide)")
+	searchCmd.Flags().BoolVar(&fullFetch, "full", false, "Fetch full messages instead of headers only")
+	searchCmd.Flags().StringVar(&sinceID, "since", "", "Only list messages newer than this message ID")
+	searchCmd.Flags().BoolVar(&utcTimes, "utc", false, "Show dates in UTC instead of local time")
+	searchCmd.Flags().StringVar(&outputTemplate, "template", "", "Go template for each message, or @file (e.g. '{{.Received}} {{.From}} {{.Subject}}')")
+	searchCmd.Flags().StringVar(&sortKey, "sort", "", "Sort the fetched results by date, -date or subject")
+	searchCmd.Flags().BoolVar(&allPages, "all", false, "Fetch every matching message instead of --max")
+	searchCmd.Flags().BoolVar(&dedupeThreads, "dedupe", false, "Show only the most recent message of each thread")
+	addQueryFlags(searchCmd)
+	searchCmd.Flags().BoolVar(&exitCode, "exit-code", false, "Exit with status 1 when no messages match")
 }
 
 func setupSendFlags() {
-	sendCmd.Flags().StringVar(&to, "to", "", "Recipient email (required)")
+	sendCmd.Flags().StringVar(&to, "to", "", "Recipient email (required unless --recipients-file)")
 	sendCmd.Flags().StringVar(&subject, "subject", "", "Email subject (required)")
 	sendCmd.Flags().StringVar(&body, "body", "", "Email body (required)")
-	sendCmd.Flags().StringVar(&cc, "cc", "", "CC recipients (comma-separated)")
-	sendCmd.Flags().StringVar(&bcc, "bcc", "", "BCC recipients (comma-separated)")
+	sendCmd.Flags().StringArrayVar(&cc, "cc", []string{}, "CC recipients (repeatable, or comma-separated)")
+	sendCmd.Flags().StringArrayVar(&bcc, "bcc", []string{}, "BCC recipients (repeatable, or comma-separated)")
 	sendCmd.Flags().StringSliceVar(&attach, "attach", []string{}, "Attachment file paths")
-	sendCmd.MarkFlagRequired("to")
+	sendCmd.Flags().StringArrayVar(&attachURLs, "attach-url", []string{}, "Download a URL and attach it (repeatable)")
+	sendCmd.Flags().StringVar(&icsFile, "ics", "", "iCalendar file sent as a meeting invite")
+	sendCmd.Flags().StringVar(&replyTo, "reply-to", "", "Address replies should be sent to")
+	sendCmd.Flags().StringVar(&inReplyTo, "in-reply-to", "", "Message-ID header of the message this replies to")
+	sendCmd.Flags().StringVar(&references, "references", "", "Message-IDs for the References header, space-separated (default --in-reply-to)")
+	sendCmd.Flags().StringVar(&threadID, "thread-id", "", "Gmail thread ID to add the message to")
+	sendCmd.Flags().StringVar(&priority, "priority", "", "Message priority: high, normal or low")
+	sendCmd.Flags().StringVar(&signatureFile, "signature-file", os.Getenv("EMAIL_MANAGER_SIGNATURE_FILE"), "File appended to the body as a signature (env EMAIL_MANAGER_SIGNATURE_FILE)")
+	sendCmd.Flags().StringVar(&recipientsFile, "recipients-file", "", "CSV file of recipients for a mail merge (needs an email column)")
+	sendCmd.Flags().DurationVar(&sendDelay, "delay", time.Second, "Delay between mail merge sends")
+	sendCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Print the message instead of sending it")
+	sendCmd.Flags().StringVar(&scheduleAt, "schedule", "", "Save as a draft and send later: a duration (2h) or a time (2006-01-02 15:04, RFC3339)")
+	sendCmd.Flags().IntVar(&confirmThreshold, "confirm-threshold", 10, "Ask for confirmation above this many To/Cc/Bcc recipients (0 to disable)")
+	sendCmd.Flags().BoolVarP(&assumeYes, "yes", "y", false, "Send without asking for confirmation")
+	sendCmd.Flags().BoolVar(&forceSend, "force", false, "Send even if an identical message was sent in the last hour")
+	sendCmd.Flags().IntVar(&wrapWidth, "wrap", 0, "Word-wrap the body at this column, e.g. 78 (0 leaves lines as they are)")
+	sendCmd.Flags().StringVar(&trackingPixel, "tracking-pixel", "", "Add an HTML body loading this URL as a 1x1 image to track opens")
+	sendCmd.MarkFlagsOneRequired("to", "recipients-file")
+	sendCmd.MarkFlagsMutuallyExclusive("to", "recipients-file")
+	sendCmd.MarkFlagsMutuallyExclusive("ics", "recipients-file")
+	sendCmd.MarkFlagsMutuallyExclusive("schedule", "recipients-file")
+	sendCmd.MarkFlagsMutuallyExclusive("in-reply-to", "recipients-file")
+	sendCmd.MarkFlagsMutuallyExclusive("references", "recipients-file")
+	sendCmd.MarkFlagsMutuallyExclusive("thread-id", "recipients-file")
+	sendCmd.MarkFlagsMutuallyExclusive("schedule", "dry-run")
 	sendCmd.MarkFlagRequired("subject")
 	sendCmd.MarkFlagRequired("body")
 }
 
+func setupSendScheduledFlags() {
+	sendScheduledCmd.Flags().BoolVar(&listScheduled, "list", false, "List the pending scheduled emails instead of sending")
+}
+
+func setupSyncFlags() {
+	syncCmd.Flags().Uint64Var(&syncSinceID, "since-id", 0, "History ID to sync from (default the one stored by the last sync)")
+	syncCmd.Flags().StringVar(&downloadDir, "dir", "~/Downloads", "Download directory; {date}, {from} and {subject} are replaced from each message")
+	syncCmd.Flags().StringSliceVar(&includePatterns, "include", []string{}, "Only download attachments whose filename matches a glob, e.g. '*.csv' (repeatable)")
+	syncCmd.Flags().StringVar(&historyLabel, "label-id", "", "Only sync messages added with this label (name or ID)")
+	syncCmd.Flags().IntVar(&concurrency, "concurrency", 4, "Number of attachments downloaded at once")
+}
+
+func setupTrashCommands() {
+	trashListCmd.Flags().Int64Var(&maxResults, "max", 10, "Maximum results")
+	trashListCmd.Flags().IntVar(&snippetWidth, "snippet-width", 80, "Snippet width in characters (0 to hide)")
+	trashEmptyCmd.Flags().BoolVarP(&assumeYes, "yes", "y", false, "Delete without asking for confirmation")
+
+	trashCmd.AddCommand(trashListCmd)
+	trashCmd.AddCommand(trashEmptyCmd)
+}
+
+func setupUnsubscribeFlags() {
+	unsubscribeCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Show how the unsubscription would be done without doing it")
+	unsubscribeCmd.Flags().BoolVar(&openURL, "open", false, "Open the unsubscribe page in a browser when there is no one-click or mailto: method")
+}
+
+func setupVacationCommands() {
+	vacationSetCmd.Flags().StringVar(&subject, "subject", "", "Auto-reply subject")
+	vacationSetCmd.Flags().StringVar(&body, "body", "", "Auto-reply body (required)")
+	vacationSetCmd.Flags().StringVar(&vacationStart, "start", "", "Start date (YYYY-MM-DD or RFC3339)")
+	vacationSetCmd.Flags().StringVar(&vacationEnd, "end", "", "End date (YYYY-MM-DD or RFC3339)")
+	vacationSetCmd.MarkFlagRequired("body")
+
+	vacationCmd.AddCommand(vacationSetCmd)
+	vacationCmd.AddCommand(vacationOffCmd)
+	vacationCmd.AddCommand(vacationStatusCmd)
+}
+
+func setupWatchFlags() {
+	watchCmd.Flags().StringVar(&watchQuery, "query", "is:unread", "Gmail query string")
+	watchCmd.Flags().Int64Var(&watchMax, "max", 10, "Maximum results per poll")
+	watchCmd.Flags().DurationVar(&pollInterval, "interval", 30*time.Second, "Polling interval")
+	watchCmd.Flags().StringVar(&execHook, "exec", "", "Shell command to run for each new message")
+}
+
 // Command handler functions (alphabetically ordered)
 
 func runApplyLabel(cmd *cobra.Command, args []string) error {
@@ -195,16 +1006,16 @@ func runApplyLabel(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	req := &gmailapi.ModifyMessageRequest{
-		AddLabelIds: []string{args[1]},
+	labelID, err := gmail.ResolveLabelID(service, args[1])
+	if err != nil {
+		return err
 	}
 
-	_, err = service.Users.Messages.Modify("me", args[0], req).Do()
-	if err != nil {
+	if err := gmail.ModifyLabels(service, args[:1], []string{labelID}, nil); err != nil {
 		return fmt.Errorf("error applying label: %w", err)
 	}
 
-	fmt.Fprintf(os.Stderr, "Label applied\n")
+	success("Label applied")
 	return nil
 }
 
@@ -215,253 +1026,2608 @@ func runArchive(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	req := &gmailapi.ModifyMessageRequest{
-		RemoveLabelIds: []string{"INBOX"},
+	remove := []string{"INBOX"}
+	if markRead {
+		remove = append(remove, "UNREAD")
 	}
 
-	_, err = service.Users.Messages.Modify("me", args[0], req).Do()
-	if err != nil {
+	if err := gmail.ModifyLabels(service, args, nil, remove); err != nil {
 		return fmt.Errorf("error archiving: %w", err)
 	}
 
-	fmt.Fprintf(os.Stderr, "Message archived\n")
+	if markRead {
+		success("Marked as read and archived %d message(s)", len(args))
+		return nil
+	}
+	success("Archived %d message(s)", len(args))
 	return nil
 }
 
-func runCreateLabel(cmd *cobra.Command, args []string) error {
-	ctx := context.Background()
-	service, err := gmail.GetService(ctx)
+func runBrowse(cmd *cobra.Command, args []string) error {
+	if !isatty.IsTerminal(os.Stdin.Fd()) || !isatty.IsTerminal(os.Stdout.Fd()) {
+		return fmt.Errorf("browse needs an interactive terminal")
+	}
+
+	service, err := gmail.GetService(context.Background())
 	if err != nil {
 		return err
 	}
 
-	label := &gmailapi.Label{
-		Name: args[0],
-	}
+	b := &browser{service: service, query: browseQuery, pageSize: browsePageSize}
+	return b.run()
+}
 
-	result, err := service.Users.Labels.Create("me", label).Do()
+func runCleanupSender(cmd *cobra.Command, args []string) error {
+	address, err := mail.ParseAddress(args[0])
 	if err != nil {
-		return fmt.Errorf("error creating label: %w", err)
+		return fmt.Errorf("invalid address %q: %w", args[0], err)
 	}
 
-	fmt.Fprintf(os.Stderr, "Label created: %s (ID: %s)\n", result.Name, result.Id)
-	return nil
-}
-
-func runDelete(cmd *cobra.Command, args []string) error {
 	ctx := context.Background()
 	service, err := gmail.GetService(ctx)
 	if err != nil {
 		return err
 	}
 
-	_, err = service.Users.Messages.Trash("me", args[0]).Do()
+	messageIDs, err := queryMessageIDs(ctx, service, gmail.BuildQuery("", gmail.QueryOptions{From: address.Address}))
 	if err != nil {
-		return fmt.Errorf("error deleting: %w", err)
+		return err
+	}
+	if len(messageIDs) == 0 {
+		fmt.Fprintf(os.Stderr, "No messages from %s\n", address.Address)
+		return nil
+	}
+
+	fmt.Fprintf(os.Stderr, "%d message(s) from %s\n", len(messageIDs), address.Address)
+	if err := printMessageSample(service, messageIDs); err != nil {
+		return err
+	}
+	if !assumeYes && !confirm(fmt.Sprintf("Move %d message(s) to the trash?", len(messageIDs))) {
+		return fmt.Errorf("cleanup cancelled")
 	}
 
-	fmt.Fprintf(os.Stderr, "Message deleted\n")
+	if err := gmail.ModifyLabels(service, messageIDs, []string{"TRASH"}, []string{"INBOX"}); err != nil {
+		return fmt.Errorf("error trashing messages: %w", err)
+	}
+	success("Moved %d message(s) from %s to the trash", len(messageIDs), address.Address)
 	return nil
 }
 
-func runDownloadAttachments(cmd *cobra.Command, args []string) error {
+func runContacts(cmd *cobra.Command, args []string) error {
+	if contactsScan <= 0 {
+		return fmt.Errorf("--scan must be positive")
+	}
+
 	ctx := context.Background()
 	service, err := gmail.GetService(ctx)
 	if err != nil {
 		return err
 	}
 
-	messageID := args[0]
-
-	// Get the message
-	msg, err := service.Users.Messages.Get("me", messageID).Do()
-	if err != nil {
-		return fmt.Errorf("error getting message: %w", err)
-	}
-
-	// Expand tilde in download directory
-	dir, err := gmail.ExpandTilde(downloadDir)
+	contacts, err := gmail.Contacts(service, contactsScan, refreshContacts)
 	if err != nil {
 		return err
 	}
 
-	// Create download directory if it doesn't exist
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("error creating download directory: %w", err)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, contact := range contacts {
+		fmt.Fprintf(w, "%s\t%d\t%s\n", contact.Address, contact.Count, contact.Name)
 	}
+	return w.Flush()
+}
 
-	// Process attachments
-	attachmentCount := 0
-	if err := gmail.ProcessAttachments(service, messageID, msg.Payload, dir, &attachmentCount); err != nil {
-		return err
+func runCreateFilter(cmd *cobra.Command, args []string) error {
+	criteria := &gmailapi.FilterCriteria{
+		From:    from,
+		To:      to,
+		Subject: subject,
+		Query:   query,
 	}
-
-	if attachmentCount == 0 {
-		fmt.Fprintf(os.Stderr, "No attachments found\n")
-		return nil
+	if from == "" && to == "" && subject == "" && query == "" {
+		return fmt.Errorf("at least one of --from, --to, --subject or --query is required")
+	}
+	if len(addLabels) == 0 && !filterArchive {
+		return fmt.Errorf("at least one of --add-label or --archive is required")
 	}
 
-	fmt.Fprintf(os.Stderr, "Downloaded %d attachment(s) to %s\n", attachmentCount, dir)
-	return nil
-}
-
-func runGet(cmd *cobra.Command, args []string) error {
 	ctx := context.Background()
 	service, err := gmail.GetService(ctx)
 	if err != nil {
 		return err
 	}
 
-	msg, err := service.Users.Messages.Get("me", args[0]).Do()
+	labelIDs, err := gmail.ResolveLabelIDs(service, addLabels)
 	if err != nil {
-		return fmt.Errorf("error getting message: %w", err)
+		return err
 	}
 
-	// Print headers
-	for _, header := range msg.Payload.Headers {
-		if header.Name == "From" || header.Name == "To" || header.Name == "Subject" || header.Name == "Date" {
-			fmt.Printf("%s: %s\n", header.Name, header.Value)
-		}
+	action := &gmailapi.FilterAction{
+		AddLabelIds: labelIDs,
 	}
-
-	// Print body
-	fmt.Println("\n" + strings.Repeat("=", 80))
-	body := gmail.GetBody(msg.Payload)
-	fmt.Println(body)
-
-	return nil
-}
-
-func runList(cmd *cobra.Command, args []string) error {
-	ctx := context.Background()
-	service, err := gmail.GetService(ctx)
-	if err != nil {
-		return err
+	if filterArchive {
+		action.RemoveLabelIds = []string{"INBOX"}
 	}
 
-	call := service.Users.Messages.List("me").MaxResults(maxResults)
-	if query != "" {
-		call = call.Q(query)
+	filter := &gmailapi.Filter{
+		Criteria: criteria,
+		Action:   action,
 	}
 
-	response, err := call.Do()
+	result, err := service.Users.Settings.Filters.Create(gmail.UserID, filter).Do()
 	if err != nil {
-		return fmt.Errorf("error listing messages: %w", err)
+		return fmt.Errorf("error creating filter: %w", err)
 	}
 
-	return gmail.ListMessagesWithDetails(service, response.Messages)
+	success("Filter created (ID: %s)", result.Id)
+	return nil
 }
 
-func runListLabels(cmd *cobra.Command, args []string) error {
-	ctx := context.Background()
+func runCreateLabel(cmd *cobra.Command, args []string) error {
+	label := &gmailapi.Label{
+		Name: args[0],
+	}
+
+	switch labelListVisibility {
+	case "", "labelShow", "labelShowIfUnread", "labelHide":
+		label.LabelListVisibility = labelListVisibility
+	default:
+		return fmt.Errorf("invalid --label-list-visibility %q: use labelShow, labelShowIfUnread or labelHide", labelListVisibility)
+	}
+
+	switch messageListVisibility {
+	case "", "show", "hide":
+		label.MessageListVisibility = messageListVisibility
+	default:
+		return fmt.Errorf("invalid --message-list-visibility %q: use show or hide", messageListVisibility)
+	}
+
+	if labelColor != "" {
+		color, err := parseLabelColor(labelColor)
+		if err != nil {
+			return err
+		}
+		label.Color = color
+	}
+
+	ctx := context.Background()
 	service, err := gmail.GetService(ctx)
 	if err != nil {
 		return err
 	}
 
-	response, err := service.Users.Labels.List("me").Do()
+	// Nested labels are created through "/" in the name; Gmail requires the
+	// parent to exist for the label to appear nested
+	if i := strings.LastIndex(label.Name, "/"); i > 0 {
+		parent := label.Name[:i]
+		if _, err := gmail.ResolveLabelID(service, parent); err != nil {
+			if errors.Is(err, gmail.ErrLabelNotFound) {
+				return fmt.Errorf("parent label %q does not exist, create it first", parent)
+			}
+			return err
+		}
+	}
+
+	result, err := service.Users.Labels.Create(gmail.UserID, label).Do()
 	if err != nil {
-		return fmt.Errorf("error listing labels: %w", err)
+		return fmt.Errorf("error creating label: %w", err)
 	}
 
-	for _, label := range response.Labels {
-		fmt.Printf("%s (ID: %s)\n", label.Name, label.Id)
+	success("Label created: %s (ID: %s)", result.Name, result.Id)
+	return nil
+}
+
+func runDelete(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	service, err := gmail.GetService(ctx)
+	if err != nil {
+		return err
+	}
+
+	if threadMode {
+		if _, err := service.Users.Threads.Trash(gmail.UserID, args[0]).Do(); err != nil {
+			return fmt.Errorf("error deleting thread: %w", err)
+		}
+		success("Thread deleted")
+		return nil
+	}
+
+	_, err = service.Users.Messages.Trash(gmail.UserID, args[0]).Do()
+	if err != nil {
+		return fmt.Errorf("error deleting: %w", err)
 	}
 
+	success("Message deleted")
 	return nil
 }
 
-func runRead(cmd *cobra.Command, args []string) error {
+func runDeleteFilter(cmd *cobra.Command, args []string) error {
 	ctx := context.Background()
 	service, err := gmail.GetService(ctx)
 	if err != nil {
 		return err
 	}
 
-	req := &gmailapi.ModifyMessageRequest{
-		RemoveLabelIds: []string{"UNREAD"},
+	if err := service.Users.Settings.Filters.Delete(gmail.UserID, args[0]).Do(); err != nil {
+		return fmt.Errorf("error deleting filter: %w", err)
 	}
 
-	_, err = service.Users.Messages.Modify("me", args[0], req).Do()
+	success("Filter deleted")
+	return nil
+}
+
+func runDiff(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	service, err := gmail.GetService(ctx)
 	if err != nil {
-		return fmt.Errorf("error marking as read: %w", err)
+		return err
+	}
+
+	texts := make([][]string, len(args))
+	for i, id := range args {
+		msg, err := service.Users.Messages.Get(gmail.UserID, id).Do()
+		if err != nil {
+			return gmail.MessageError(id, err)
+		}
+		texts[i] = messageLines(msg)
 	}
 
-	fmt.Fprintf(os.Stderr, "Message marked as read\n")
+	if !writeUnifiedDiff(os.Stdout, args[0], args[1], texts[0], texts[1], 3) {
+		fmt.Fprintf(os.Stderr, "Messages are identical\n")
+	}
 	return nil
 }
 
-func runSearch(cmd *cobra.Command, args []string) error {
+func runDownloadAttachments(cmd *cobra.Command, args []string) error {
 	ctx := context.Background()
 	service, err := gmail.GetService(ctx)
 	if err != nil {
 		return err
 	}
 
-	response, err := service.Users.Messages.List("me").Q(args[0]).MaxResults(maxResults).Do()
+	for _, pattern := range includePatterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid --include pattern %q: %w", pattern, err)
+		}
+	}
+
+	messageID := args[0]
+
+	// Get the message
+	msg, err := service.Users.Messages.Get(gmail.UserID, messageID).Do()
 	if err != nil {
-		return fmt.Errorf("error searching: %w", err)
+		return gmail.MessageError(messageID, err)
 	}
 
-	fmt.Fprintf(os.Stderr, "Found %d messages\n\n", len(response.Messages))
+	if toStdout {
+		return writeAttachmentToStdout(service, msg)
+	}
 
-	return gmail.ListMessagesWithDetails(service, response.Messages)
+	return saveAttachments(service, msg)
 }
 
-func runSend(cmd *cobra.Command, args []string) error {
+func runGet(cmd *cobra.Command, args []string) error {
+	if outputFormat != "text" && outputFormat != "markdown" {
+		return fmt.Errorf("invalid output format %q: must be text or markdown", outputFormat)
+	}
+	tmpl, err := parseTemplate()
+	if err != nil {
+		return err
+	}
+
+	switch messageFormat {
+	case "full":
+	case "metadata", "minimal":
+		if getHTML || renderHTML || savePath != "" || getAttachments || outputFormat != "text" {
+			return fmt.Errorf("--format %s has no body: --html, --render, --save, --download-attachments and --output need --format full", messageFormat)
+		}
+	case "raw":
+		if tmpl != nil || getConversation || getHTML || renderHTML || getAttachments || authResults || outputFormat != "text" {
+			return fmt.Errorf("--format raw prints the message source and only combines with --save")
+		}
+	default:
+		return fmt.Errorf("invalid format %q: must be full, metadata, minimal or raw", messageFormat)
+	}
+
+	if args[0] == "-" {
+		if messageFormat != "full" {
+			return fmt.Errorf("get - always fetches full messages and cannot be used with --format")
+		}
+		if tmpl != nil || savePath != "" || getConversation {
+			return fmt.Errorf("get - prints JSON Lines and cannot be used with --template, --save or --conversation")
+		}
+		return getFromStdin()
+	}
+
+	ctx := context.Background()
+	service, err := gmail.GetService(ctx)
+	if err != nil {
+		return err
+	}
+
+	msg, err := service.Users.Messages.Get(gmail.UserID, args[0]).Format(messageFormat).Do()
+	if err != nil {
+		return gmail.MessageError(args[0], err)
+	}
+
+	if messageFormat == "raw" {
+		raw, err := gmail.DecodeRaw(msg.Raw)
+		if err != nil {
+			return err
+		}
+		if savePath != "" {
+			return saveBody(service, msg, string(raw))
+		}
+		_, err = os.Stdout.Write(raw)
+		return err
+	}
+
+	if !getConversation {
+		return showMessage(service, msg, tmpl)
+	}
+
+	thread, err := service.Users.Threads.Get(gmail.UserID, msg.ThreadId).Format(messageFormat).Do()
+	if err != nil {
+		return fmt.Errorf("error getting thread: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "Thread %s: %d message(s)\n\n", thread.Id, len(thread.Messages))
+	for i, threadMsg := range thread.Messages {
+		if i > 0 {
+			fmt.Println()
+		}
+		if err := showMessage(service, threadMsg, tmpl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runHistory(cmd *cobra.Command, args []string) error {
 	ctx := context.Background()
 	service, err := gmail.GetService(ctx)
 	if err != nil {
 		return err
 	}
 
-	var message strings.Builder
-	message.WriteString(fmt.Sprintf("To: %s\r\n", to))
-	if cc != "" {
-		message.WriteString(fmt.Sprintf("Cc: %s\r\n", cc))
+	call := service.Users.History.List(gmail.UserID).StartHistoryId(startHistoryID)
+	if historyLabel != "" {
+		labelID, err := gmail.ResolveLabelID(service, historyLabel)
+		if err != nil {
+			return err
+		}
+		call = call.LabelId(labelID)
+	}
+
+	changes := 0
+	var latest uint64
+	err = call.Pages(ctx, func(response *gmailapi.ListHistoryResponse) error {
+		latest = response.HistoryId
+		for _, h := range response.History {
+			for _, added := range h.MessagesAdded {
+				fmt.Printf("Added:          %s\n", added.Message.Id)
+				changes++
+			}
+			for _, deleted := range h.MessagesDeleted {
+				fmt.Printf("Deleted:        %s\n", deleted.Message.Id)
+				changes++
+			}
+			for _, labeled := range h.LabelsAdded {
+				fmt.Printf("Labels added:   %s (%s)\n", labeled.Message.Id, strings.Join(labeled.LabelIds, ", "))
+				changes++
+			}
+			for _, unlabeled := range h.LabelsRemoved {
+				fmt.Printf("Labels removed: %s (%s)\n", unlabeled.Message.Id, strings.Join(unlabeled.LabelIds, ", "))
+				changes++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// Gmail only keeps about a week of history; older IDs return 404
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			return fmt.Errorf("history ID %d is invalid or too old, a full sync is needed", startHistoryID)
+		}
+		return fmt.Errorf("error listing history: %w", err)
 	}
-	if bcc != "" {
-		message.WriteString(fmt.Sprintf("Bcc: %s\r\n", bcc))
+
+	fmt.Fprintf(os.Stderr, "%d change(s); latest history ID: %d\n", changes, latest)
+	return nil
+}
+
+func runImport(cmd *cobra.Command, args []string) error {
+	raw, err := os.ReadFile(args[0])
+	if err != nil {
+		return fmt.Errorf("error reading file: %w", err)
 	}
-	message.WriteString(fmt.Sprintf("Subject: %s\r\n", subject))
-	message.WriteString("\r\n")
-	message.WriteString(body)
 
-	raw := base64.URLEncoding.EncodeToString([]byte(message.String()))
+	ctx := context.Background()
+	service, err := gmail.GetService(ctx)
+	if err != nil {
+		return err
+	}
 
-	msg := &gmailapi.Message{
-		Raw: raw,
+	labelIDs, err := gmail.ResolveLabelIDs(service, addLabels)
+	if err != nil {
+		return err
 	}
 
-	_, err = service.Users.Messages.Send("me", msg).Do()
+	msg, err := gmail.ImportMessage(service, raw, labelIDs)
 	if err != nil {
-		return fmt.Errorf("error sending email: %w", err)
+		return err
 	}
 
-	fmt.Fprintf(os.Stderr, "Email sent successfully to %s\n", to)
+	success("Message imported (ID: %s)", msg.Id)
 	return nil
 }
 
-func runUnread(cmd *cobra.Command, args []string) error {
+func runImportant(cmd *cobra.Command, args []string) error {
 	ctx := context.Background()
 	service, err := gmail.GetService(ctx)
 	if err != nil {
 		return err
 	}
 
-	req := &gmailapi.ModifyMessageRequest{
-		AddLabelIds: []string{"UNREAD"},
+	if err := gmail.ModifyLabels(service, args, []string{"IMPORTANT"}, nil); err != nil {
+		return fmt.Errorf("error marking as important: %w", err)
+	}
+
+	success("Marked %d message(s) as important", len(args))
+	return nil
+}
+
+func runInsert(cmd *cobra.Command, args []string) error {
+	raw, err := os.ReadFile(args[0])
+	if err != nil {
+		return fmt.Errorf("error reading file: %w", err)
 	}
 
-	_, err = service.Users.Messages.Modify("me", args[0], req).Do()
+	ctx := context.Background()
+	service, err := gmail.GetService(ctx)
 	if err != nil {
-		return fmt.Errorf("error marking as unread: %w", err)
+		return err
+	}
+
+	labelIDs, err := gmail.ResolveLabelIDs(service, addLabels)
+	if err != nil {
+		return err
+	}
+
+	msg, err := gmail.InsertMessage(service, raw, labelIDs)
+	if err != nil {
+		return err
+	}
+
+	success("Message inserted (ID: %s)", msg.Id)
+	return nil
+}
+
+func runList(cmd *cobra.Command, args []string) error {
+	if maxResults < 0 {
+		return usageError{fmt.Errorf("invalid --max %d: must be 0 or more", maxResults)}
+	}
+	if maxResults == 0 {
+		maxResults = defaultMaxResults
+	}
+	if withAttachments {
+		hasAttachment = true
+	}
+
+	ctx := context.Background()
+	service, err := gmail.GetService(ctx)
+	if err != nil {
+		return err
+	}
+
+	q, err := buildQuery(service, query)
+	if err != nil {
+		return err
+	}
+
+	call := service.Users.Messages.List(gmail.UserID)
+	if q != "" {
+		call = call.Q(q)
+	}
+	if len(listLabels) > 0 {
+		labelIDs, err := gmail.ResolveLabelIDs(service, listLabels)
+		if err != nil {
+			return err
+		}
+		call = call.LabelIds(labelIDs...)
+	}
+
+	messages, _, err := gmail.ListMessagesUpTo(call, maxResults)
+	if err != nil {
+		return fmt.Errorf("error listing messages: %w", err)
+	}
+
+	return listMessages(cmd, service, withoutSince(messages))
+}
+
+func runListFilters(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	service, err := gmail.GetService(ctx)
+	if err != nil {
+		return err
+	}
+
+	response, err := service.Users.Settings.Filters.List(gmail.UserID).Do()
+	if err != nil {
+		return fmt.Errorf("error listing filters: %w", err)
+	}
+
+	if len(response.Filter) == 0 {
+		fmt.Fprintf(os.Stderr, "No filters found\n")
+		return nil
+	}
+
+	for _, filter := range response.Filter {
+		fmt.Printf("ID: %s\n", filter.Id)
+		if c := filter.Criteria; c != nil {
+			if c.From != "" {
+				fmt.Printf("From: %s\n", c.From)
+			}
+			if c.To != "" {
+				fmt.Printf("To: %s\n", c.To)
+			}
+			if c.Subject != "" {
+				fmt.Printf("Subject: %s\n", c.Subject)
+			}
+			if c.Query != "" {
+				fmt.Printf("Query: %s\n", c.Query)
+			}
+		}
+		if a := filter.Action; a != nil {
+			if len(a.AddLabelIds) > 0 {
+				fmt.Printf("Add labels: %s\n", strings.Join(a.AddLabelIds, ", "))
+			}
+			if len(a.RemoveLabelIds) > 0 {
+				fmt.Printf("Remove labels: %s\n", strings.Join(a.RemoveLabelIds, ", "))
+			}
+			if a.Forward != "" {
+				fmt.Printf("Forward: %s\n", a.Forward)
+			}
+		}
+		fmt.Println("---")
+	}
+
+	return nil
+}
+
+func runListLabels(cmd *cobra.Command, args []string) error {
+	if labelType != "" && labelType != "system" && labelType != "user" {
+		return fmt.Errorf("invalid --type %q: must be system or user", labelType)
+	}
+
+	ctx := context.Background()
+	service, err := gmail.GetService(ctx)
+	if err != nil {
+		return err
+	}
+
+	response, err := service.Users.Labels.List(gmail.UserID).Do()
+	if err != nil {
+		return fmt.Errorf("error listing labels: %w", err)
+	}
+
+	var labels []*gmailapi.Label
+	for _, label := range response.Labels {
+		if labelType == "" || label.Type == labelType {
+			labels = append(labels, label)
+		}
+	}
+	slices.SortFunc(labels, func(a, b *gmailapi.Label) int {
+		return strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+	})
+
+	if !labelCounts {
+		for _, label := range labels {
+			fmt.Printf("%s (ID: %s)\n", label.Name, label.Id)
+		}
+		return nil
+	}
+
+	// Labels.List leaves out the counts, so each label is fetched
+	ids := make([]string, len(labels))
+	for i, label := range labels {
+		ids[i] = label.Id
+	}
+	labels, err = gmail.GetLabels(service, ids, 8)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "LABEL\tID\tMESSAGES\tUNREAD\tTHREADS\tUNREAD THREADS")
+	for _, label := range labels {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\n", label.Name, label.Id,
+			label.MessagesTotal, label.MessagesUnread, label.ThreadsTotal, label.ThreadsUnread)
+	}
+	return w.Flush()
+}
+
+func runModify(cmd *cobra.Command, args []string) error {
+	if len(addLabels) == 0 && len(removeLabels) == 0 {
+		return fmt.Errorf("at least one of --add or --remove is required")
+	}
+
+	ctx := context.Background()
+	service, err := gmail.GetService(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Resolve both lists with a single label lookup
+	labelIDs, err := gmail.ResolveLabelIDs(service, append(append([]string{}, addLabels...), removeLabels...))
+	if err != nil {
+		return err
+	}
+	add, remove := labelIDs[:len(addLabels)], labelIDs[len(addLabels):]
+
+	if err := gmail.ModifyLabels(service, args, add, remove); err != nil {
+		return fmt.Errorf("error modifying messages: %w", err)
+	}
+
+	success("Modified %d message(s)", len(args))
+	return nil
+}
+
+func runMove(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	service, err := gmail.GetService(ctx)
+	if err != nil {
+		return err
+	}
+
+	messageIDs := args[:len(args)-1]
+	labelID, err := gmail.ResolveLabelID(service, args[len(args)-1])
+	if err != nil {
+		return err
+	}
+
+	var remove []string
+	if !keepInbox {
+		remove = []string{"INBOX"}
 	}
 
-	fmt.Fprintf(os.Stderr, "Message marked as unread\n")
+	if err := gmail.ModifyLabels(service, messageIDs, []string{labelID}, remove); err != nil {
+		return fmt.Errorf("error moving messages: %w", err)
+	}
+
+	success("Moved %d message(s) to %s", len(messageIDs), args[len(args)-1])
 	return nil
 }
 
+func runMute(cmd *cobra.Command, args []string) error {
+	address, err := mail.ParseAddress(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %w", args[0], err)
+	}
+
+	ctx := context.Background()
+	service, err := gmail.GetService(ctx)
+	if err != nil {
+		return err
+	}
+
+	filter := &gmailapi.Filter{
+		Criteria: &gmailapi.FilterCriteria{From: address.Address},
+		Action:   &gmailapi.FilterAction{RemoveLabelIds: []string{"INBOX", "UNREAD"}},
+	}
+	result, err := service.Users.Settings.Filters.Create(gmail.UserID, filter).Do()
+	if err != nil {
+		return fmt.Errorf("error creating filter: %w", err)
+	}
+	success("Muted %s (filter ID: %s)", address.Address, result.Id)
+
+	if !trashExisting {
+		return nil
+	}
+
+	messageIDs, err := queryMessageIDs(ctx, service, gmail.BuildQuery("", gmail.QueryOptions{From: address.Address}))
+	if err != nil {
+		return err
+	}
+	if len(messageIDs) == 0 {
+		fmt.Fprintf(os.Stderr, "No existing messages from %s\n", address.Address)
+		return nil
+	}
+
+	if err := gmail.ModifyLabels(service, messageIDs, []string{"TRASH"}, []string{"INBOX"}); err != nil {
+		return fmt.Errorf("error trashing messages: %w", err)
+	}
+	success("Moved %d existing message(s) to the trash", len(messageIDs))
+	return nil
+}
+
+func runNotImportant(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	service, err := gmail.GetService(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := gmail.ModifyLabels(service, args, nil, []string{"IMPORTANT"}); err != nil {
+		return fmt.Errorf("error marking as not important: %w", err)
+	}
+
+	success("Marked %d message(s) as not important", len(args))
+	return nil
+}
+
+func runPurge(cmd *cobra.Command, args []string) error {
+	if !gmail.ValidAge(olderThan) {
+		return fmt.Errorf("invalid --older-than %q: use a number followed by d, m or y (e.g. 90d)", olderThan)
+	}
+
+	ctx := context.Background()
+	service, err := gmail.GetService(ctx)
+	if err != nil {
+		return err
+	}
+
+	q := gmail.BuildQuery(purgeQuery, gmail.QueryOptions{OlderThan: olderThan})
+	if verbose {
+		fmt.Fprintf(os.Stderr, "Query: %s\n", q)
+	}
+
+	messageIDs, err := queryMessageIDs(ctx, service, q)
+	if err != nil {
+		return err
+	}
+	if len(messageIDs) == 0 {
+		fmt.Fprintf(os.Stderr, "No messages to purge\n")
+		return nil
+	}
+
+	fmt.Fprintf(os.Stderr, "%d message(s) match %q\n", len(messageIDs), q)
+	if err := printMessageSample(service, messageIDs); err != nil {
+		return err
+	}
+
+	if !assumeYes {
+		fmt.Fprintf(os.Stderr, "Nothing changed, run again with --yes to purge them\n")
+		return nil
+	}
+
+	if permanentDelete {
+		if err := gmail.DeleteMessages(service, messageIDs); err != nil {
+			return fmt.Errorf("error deleting messages: %w", err)
+		}
+		success("Permanently deleted %d message(s)", len(messageIDs))
+		return nil
+	}
+
+	if err := gmail.ModifyLabels(service, messageIDs, []string{"TRASH"}, []string{"INBOX"}); err != nil {
+		return fmt.Errorf("error trashing messages: %w", err)
+	}
+	success("Moved %d message(s) to the trash", len(messageIDs))
+	return nil
+}
+
+func runRead(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	service, err := gmail.GetService(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := gmail.ModifyLabels(service, args, nil, []string{"UNREAD"}); err != nil {
+		return fmt.Errorf("error marking as read: %w", err)
+	}
+
+	success("Marked %d message(s) as read", len(args))
+	return nil
+}
+
+func runReply(cmd *cobra.Command, args []string) error {
+	return reply(args[0], false)
+}
+
+func runReplyAll(cmd *cobra.Command, args []string) error {
+	return reply(args[0], true)
+}
+
+func runResend(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	service, err := gmail.GetService(ctx)
+	if err != nil {
+		return err
+	}
+
+	msg, err := service.Users.Messages.Get(gmail.UserID, args[0]).Format("raw").Do()
+	if err != nil {
+		return gmail.MessageError(args[0], err)
+	}
+	if !slices.Contains(msg.LabelIds, "SENT") {
+		return fmt.Errorf("message %s is not a sent message", args[0])
+	}
+
+	raw, err := gmail.DecodeRaw(msg.Raw)
+	if err != nil {
+		return err
+	}
+	raw, err = gmail.PrepareResend(raw, to)
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		fmt.Println(string(raw))
+		fmt.Println(strings.Repeat("=", 80))
+		fmt.Fprintf(os.Stderr, "Dry run: message not sent\n")
+		return nil
+	}
+
+	sent, err := gmail.SendRaw(service, raw)
+	if err != nil {
+		return err
+	}
+
+	recipients := to
+	if parsed, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		recipients = strings.Join(splitAddresses(parsed.Header.Get("To"), parsed.Header.Get("Cc"), parsed.Header.Get("Bcc")), ", ")
+	}
+	success("Message resent to %s", recipients)
+	fmt.Println(sent.Id)
+	return nil
+}
+
+func runSearch(cmd *cobra.Command, args []string) error {
+	if maxResults < 0 {
+		return usageError{fmt.Errorf("invalid --max %d: must be 0 or more", maxResults)}
+	}
+	switch sortKey {
+	case "", "date", "-date", "subject":
+	default:
+		return fmt.Errorf("invalid --sort %q: use date, -date or subject", sortKey)
+	}
+
+	var base string
+	if len(args) > 0 {
+		base = args[0]
+	}
+	if base == "-" {
+		// Generated queries may hold quotes and parentheses that are
+		// awkward to pass as an argument
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("error reading query: %w", err)
+		}
+		base = strings.Join(strings.Fields(string(data)), " ")
+	}
+
+	ctx := context.Background()
+	service, err := gmail.GetService(ctx)
+	if err != nil {
+		return err
+	}
+
+	q, err := buildQuery(service, base)
+	if err != nil {
+		return err
+	}
+	if q == "" {
+		return fmt.Errorf("a query or at least one search flag is required")
+	}
+
+	var (
+		found    []*gmailapi.Message
+		estimate int64
+	)
+	countOnly := maxResults == 0 && !allPages
+	if allPages || countOnly {
+		err = service.Users.Messages.List(gmail.UserID).Q(q).MaxResults(500).Pages(ctx, func(response *gmailapi.ListMessagesResponse) error {
+			found = append(found, response.Messages...)
+			return nil
+		})
+	} else {
+		// The estimate covers every page, not just the --max returned
+		found, estimate, err = gmail.ListMessagesUpTo(service.Users.Messages.List(gmail.UserID).Q(q), maxResults)
+	}
+	if err != nil {
+		return fmt.Errorf("error searching: %w", err)
+	}
+
+	messages := withoutSince(found)
+	if countOnly {
+		fmt.Println(len(messages))
+		if len(messages) == 0 && exitCode {
+			cmd.SilenceUsage = true
+			return ErrNoMessages
+		}
+		return nil
+	}
+	if estimate > int64(len(messages)) {
+		fmt.Fprintf(os.Stderr, "Showing %d of ~%d estimated messages (use --max or --all for more)\n\n", len(messages), estimate)
+	} else if len(messages) > 0 {
+		fmt.Fprintf(os.Stderr, "Found %d messages\n\n", len(messages))
+	}
+
+	return listMessages(cmd, service, messages)
+}
+
+func runSend(cmd *cobra.Command, args []string) error {
+	// Recipient groups are expanded first so every check below sees the
+	// actual addresses
+	var err error
+	if to, err = gmail.ExpandGroups(to); err != nil {
+		return err
+	}
+	for _, list := range [][]string{cc, bcc} {
+		for i := range list {
+			if list[i], err = gmail.ExpandGroups(list[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	if replyTo != "" {
+		if _, err := mail.ParseAddress(replyTo); err != nil {
+			return fmt.Errorf("invalid --reply-to address %q: %w", replyTo, err)
+		}
+	}
+	switch priority {
+	case "", "high", "normal", "low":
+	default:
+		return fmt.Errorf("invalid priority %q: must be high, normal or low", priority)
+	}
+	if wrapWidth < 0 {
+		return fmt.Errorf("invalid --wrap %d: must be 0 or more", wrapWidth)
+	}
+	if trackingPixel != "" {
+		parsed, err := url.Parse(trackingPixel)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("invalid --tracking-pixel %q: must be an http or https URL", trackingPixel)
+		}
+		fmt.Fprintf(os.Stderr, "Warning: --tracking-pixel lets %s see when, and from which IP address, each recipient opens the message\n", parsed.Host)
+	}
+
+	var sendAt time.Time
+	if scheduleAt != "" {
+		if sendAt, err = parseSchedule(scheduleAt); err != nil {
+			return err
+		}
+	}
+
+	signature, err := readSignature()
+	if err != nil {
+		return err
+	}
+
+	var calendar string
+	if icsFile != "" {
+		data, err := os.ReadFile(icsFile)
+		if err != nil {
+			return fmt.Errorf("error reading calendar file: %w", err)
+		}
+		if !strings.Contains(string(data), "BEGIN:VCALENDAR") {
+			return fmt.Errorf("%s is not an iCalendar file: no BEGIN:VCALENDAR", icsFile)
+		}
+		calendar = string(data)
+	}
+
+	// Downloads go to a copy of --attach, which a re-authorized rerun of
+	// the handler must find unchanged
+	attachments := slices.Clone(attach)
+	if len(attachURLs) > 0 {
+		dir, err := os.MkdirTemp("", "email-manager-")
+		if err != nil {
+			return fmt.Errorf("error creating temporary directory: %w", err)
+		}
+		defer os.RemoveAll(dir)
+		for _, attachURL := range attachURLs {
+			fmt.Fprintf(os.Stderr, "Downloading: %s\n", attachURL)
+			path, err := gmail.DownloadAttachment(attachURL, dir)
+			if err != nil {
+				return err
+			}
+			attachments = append(attachments, path)
+		}
+	}
+
+	email := &gmail.Email{
+		To:          to,
+		Cc:          strings.Join(cc, ", "),
+		Bcc:         strings.Join(bcc, ", "),
+		ReplyTo:     replyTo,
+		Subject:     subject,
+		Body:        gmail.AppendSignature(gmail.WrapText(body, wrapWidth), signature),
+		Attachments: attachments,
+		Priority:    priority,
+		Calendar:    calendar,
+		InReplyTo:   formatMessageIDs(inReplyTo),
+		References:  formatMessageIDs(references),
+		ThreadID:    threadID,
+	}
+	email.HTML = trackingHTML(email.Body)
+	if email.References == "" {
+		email.References = email.InReplyTo
+	}
+
+	// Check the size before authenticating so oversized messages fail fast;
+	// SendEmail checks again once mail merge bodies are rendered
+	if !dryRun {
+		if err := email.CheckSize(); err != nil {
+			return err
+		}
+	}
+
+	if recipientsFile == "" && !dryRun && !assumeYes && confirmThreshold > 0 {
+		recipients := splitAddresses(append(append([]string{to}, cc...), bcc...)...)
+		if len(recipients) > confirmThreshold {
+			fmt.Fprintf(os.Stderr, "This email will be sent to %d recipients:\n", len(recipients))
+			for _, recipient := range recipients {
+				fmt.Fprintf(os.Stderr, "  %s\n", recipient)
+			}
+			if !confirm("Send it?") {
+				return fmt.Errorf("sending cancelled")
+			}
+		}
+	}
+
+	// A dry run only builds messages, so it works without credentials
+	var service *gmailapi.Service
+	if !dryRun {
+		service, err = gmail.GetService(context.Background())
+		if err != nil {
+			return err
+		}
+	}
+
+	if recipientsFile != "" {
+		return sendMailMerge(service, signature, attachments)
+	}
+
+	if scheduleAt != "" {
+		return scheduleEmail(service, email, sendAt)
+	}
+
+	id, err := deliver(service, email)
+	if err != nil {
+		return err
+	}
+
+	if !dryRun {
+		success("Email sent successfully to %s", to)
+		fmt.Println(id)
+	}
+	return nil
+}
+
+func runSendScheduled(cmd *cobra.Command, args []string) error {
+	queue, err := gmail.LoadSchedule()
+	if err != nil {
+		return err
+	}
+
+	if listScheduled {
+		for _, entry := range queue {
+			fmt.Printf("%s  %s  %s  %s\n", entry.SendAt.Local().Format("2006-01-02 15:04"), entry.DraftID, entry.To, entry.Subject)
+		}
+		return nil
+	}
+
+	now := time.Now()
+	var due bool
+	for _, entry := range queue {
+		due = due || !entry.SendAt.After(now)
+	}
+	if !due {
+		return nil
+	}
+
+	service, err := gmail.GetService(context.Background())
+	if err != nil {
+		return err
+	}
+
+	var pending []gmail.ScheduledSend
+	failed := 0
+	for _, entry := range queue {
+		if entry.SendAt.After(now) {
+			pending = append(pending, entry)
+			continue
+		}
+
+		_, err := service.Users.Drafts.Send(entry.UserID, &gmailapi.Draft{Id: entry.DraftID}).Do()
+		var apiErr *googleapi.Error
+		switch {
+		case err == nil:
+			success("Scheduled email sent to %s", entry.To)
+		case errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound:
+			// The draft was sent or deleted by hand
+			fmt.Fprintf(os.Stderr, "Warning: draft %s no longer exists, dropping it from the schedule\n", entry.DraftID)
+		default:
+			fmt.Fprintf(os.Stderr, "Error sending draft %s to %s: %v\n", entry.DraftID, entry.To, err)
+			pending = append(pending, entry)
+			failed++
+		}
+	}
+
+	if err := gmail.SaveSchedule(pending); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d scheduled emails could not be sent and will be retried", failed)
+	}
+	return nil
+}
+
+func runSync(cmd *cobra.Command, args []string) error {
+	for _, pattern := range includePatterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid --include pattern %q: %w", pattern, err)
+		}
+	}
+
+	ctx := context.Background()
+	service, err := gmail.GetService(ctx)
+	if err != nil {
+		return err
+	}
+
+	start := syncSinceID
+	if start == 0 {
+		if start, err = gmail.LoadSyncState(); err != nil {
+			return err
+		}
+	}
+	if start == 0 {
+		// Nothing to compare against yet: start from now
+		profile, err := service.Users.GetProfile(gmail.UserID).Do()
+		if err != nil {
+			return fmt.Errorf("error getting profile: %w", err)
+		}
+		if err := gmail.SaveSyncState(profile.HistoryId); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "No previous sync; recorded history ID %d, run sync again to download new attachments\n", profile.HistoryId)
+		return nil
+	}
+
+	call := service.Users.History.List(gmail.UserID).StartHistoryId(start).HistoryTypes("messageAdded")
+	if historyLabel != "" {
+		labelID, err := gmail.ResolveLabelID(service, historyLabel)
+		if err != nil {
+			return err
+		}
+		call = call.LabelId(labelID)
+	}
+
+	var ids []string
+	seen := make(map[string]bool)
+	latest := start
+	err = call.Pages(ctx, func(response *gmailapi.ListHistoryResponse) error {
+		latest = response.HistoryId
+		for _, h := range response.History {
+			for _, added := range h.MessagesAdded {
+				if !seen[added.Message.Id] && !slices.Contains(added.Message.LabelIds, "DRAFT") {
+					seen[added.Message.Id] = true
+					ids = append(ids, added.Message.Id)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			return fmt.Errorf("history ID %d is invalid or too old, a full sync is needed", start)
+		}
+		return fmt.Errorf("error listing history: %w", err)
+	}
+
+	messages, attachments := 0, 0
+	err = gmail.FetchMessages(service, ids, "full", concurrency, func(id string, msg *gmailapi.Message, err error) error {
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			// Deleted since it was added
+			return nil
+		}
+		if err != nil {
+			return gmail.MessageError(id, err)
+		}
+		messages++
+
+		dir, err := gmail.ExpandDirTemplate(downloadDir, msg)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("error creating download directory: %w", err)
+		}
+		count := 0
+		if err := gmail.ProcessAttachments(service, msg.Id, msg.Payload, dir, includePatterns, concurrency, false, &count); err != nil {
+			return err
+		}
+		if count > 0 {
+			fmt.Fprintf(os.Stderr, "Downloaded %d attachment(s) from %s to %s\n", count, msg.Id, dir)
+		}
+		attachments += count
+		return nil
+	})
+	if err != nil {
+		// The history ID is kept so the next run retries these messages
+		return err
+	}
+
+	if err := gmail.SaveSyncState(latest); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d new message(s), %d attachment(s); next sync starts from history ID %d\n", messages, attachments, latest)
+	return nil
+}
+
+func runTrashEmpty(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	service, err := gmail.GetService(ctx)
+	if err != nil {
+		return err
+	}
+
+	var messageIDs []string
+	call := service.Users.Messages.List(gmail.UserID).LabelIds("TRASH").IncludeSpamTrash(true).MaxResults(500)
+	err = call.Pages(ctx, func(response *gmailapi.ListMessagesResponse) error {
+		for _, msg := range response.Messages {
+			messageIDs = append(messageIDs, msg.Id)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error listing trash: %w", err)
+	}
+
+	if len(messageIDs) == 0 {
+		fmt.Fprintf(os.Stderr, "Trash is already empty\n")
+		return nil
+	}
+
+	if !assumeYes && !confirm(fmt.Sprintf("Permanently delete %d message(s) from the trash?", len(messageIDs))) {
+		return fmt.Errorf("emptying trash cancelled")
+	}
+
+	if err := gmail.DeleteMessages(service, messageIDs); err != nil {
+		return fmt.Errorf("error emptying trash: %w", err)
+	}
+
+	success("Permanently deleted %d message(s)", len(messageIDs))
+	return nil
+}
+
+func runTrashList(cmd *cobra.Command, args []string) error {
+	if maxResults < 0 {
+		return usageError{fmt.Errorf("invalid --max %d: must be 0 or more", maxResults)}
+	}
+	if maxResults == 0 {
+		maxResults = defaultMaxResults
+	}
+
+	ctx := context.Background()
+	service, err := gmail.GetService(ctx)
+	if err != nil {
+		return err
+	}
+
+	call := service.Users.Messages.List(gmail.UserID).LabelIds("TRASH").IncludeSpamTrash(true)
+	messages, _, err := gmail.ListMessagesUpTo(call, maxResults)
+	if err != nil {
+		return fmt.Errorf("error listing trash: %w", err)
+	}
+
+	return listMessages(cmd, service, messages)
+}
+
+func runUnread(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	service, err := gmail.GetService(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := gmail.ModifyLabels(service, args, []string{"UNREAD"}, nil); err != nil {
+		return fmt.Errorf("error marking as unread: %w", err)
+	}
+
+	success("Marked %d message(s) as unread", len(args))
+	return nil
+}
+
+func runUnsubscribe(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	service, err := gmail.GetService(ctx)
+	if err != nil {
+		return err
+	}
+
+	msg, err := service.Users.Messages.Get(gmail.UserID, args[0]).Format("metadata").MetadataHeaders("List-Unsubscribe", "List-Unsubscribe-Post").Do()
+	if err != nil {
+		return gmail.MessageError(args[0], err)
+	}
+	unsubscribe, ok := gmail.ParseUnsubscribe(gmail.MessageHeaders(msg))
+	if !ok {
+		return fmt.Errorf("message %s has no List-Unsubscribe header", args[0])
+	}
+
+	switch {
+	case unsubscribe.OneClick:
+		if dryRun {
+			fmt.Println(unsubscribe.URL)
+			fmt.Fprintf(os.Stderr, "Dry run: would send a one-click unsubscribe POST to this URL\n")
+			return nil
+		}
+		if err := gmail.UnsubscribeOneClick(unsubscribe.URL); err != nil {
+			return err
+		}
+		success("Unsubscribed with a one-click request to %s", unsubscribe.URL)
+
+	case unsubscribe.Mailto != "":
+		email, err := gmail.UnsubscribeEmail(unsubscribe.Mailto)
+		if err != nil {
+			return err
+		}
+		id, err := deliver(service, email)
+		if err != nil {
+			return err
+		}
+		if !dryRun {
+			success("Unsubscribe request sent to %s", email.To)
+			fmt.Println(id)
+		}
+
+	default:
+		// Unsubscribing on the page may need confirmation or a login, so
+		// it is left to the user
+		fmt.Println(unsubscribe.URL)
+		if openURL && !dryRun {
+			if err := auth.OpenBrowser(unsubscribe.URL); err != nil {
+				return fmt.Errorf("error opening browser: %w", err)
+			}
+		}
+		fmt.Fprintf(os.Stderr, "Unsubscribe on this page (no one-click or mailto: method offered)\n")
+	}
+	return nil
+}
+
+func runUntrash(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	service, err := gmail.GetService(ctx)
+	if err != nil {
+		return err
+	}
+
+	if threadMode {
+		if _, err := service.Users.Threads.Untrash(gmail.UserID, args[0]).Do(); err != nil {
+			return fmt.Errorf("error restoring thread: %w", err)
+		}
+		success("Thread restored")
+		return nil
+	}
+
+	_, err = service.Users.Messages.Untrash(gmail.UserID, args[0]).Do()
+	if err != nil {
+		return fmt.Errorf("error restoring: %w", err)
+	}
+
+	success("Message restored")
+	return nil
+}
+
+func runVacationOff(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	service, err := gmail.GetService(ctx)
+	if err != nil {
+		return err
+	}
+
+	settings := &gmailapi.VacationSettings{
+		EnableAutoReply: false,
+		ForceSendFields: []string{"EnableAutoReply"},
+	}
+
+	_, err = service.Users.Settings.UpdateVacation(gmail.UserID, settings).Do()
+	if err != nil {
+		return fmt.Errorf("error disabling vacation responder: %w", err)
+	}
+
+	success("Vacation responder disabled")
+	return nil
+}
+
+func runVacationSet(cmd *cobra.Command, args []string) error {
+	settings := &gmailapi.VacationSettings{
+		EnableAutoReply:       true,
+		ResponseSubject:       subject,
+		ResponseBodyPlainText: body,
+	}
+
+	if vacationStart != "" {
+		start, err := parseDate(vacationStart)
+		if err != nil {
+			return fmt.Errorf("invalid start date: %w", err)
+		}
+		settings.StartTime = start.UnixMilli()
+	}
+
+	if vacationEnd != "" {
+		end, err := parseDate(vacationEnd)
+		if err != nil {
+			return fmt.Errorf("invalid end date: %w", err)
+		}
+		settings.EndTime = end.UnixMilli()
+	}
+
+	if settings.StartTime != 0 && settings.EndTime != 0 && settings.EndTime <= settings.StartTime {
+		return fmt.Errorf("end date must be after start date")
+	}
+
+	ctx := context.Background()
+	service, err := gmail.GetService(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = service.Users.Settings.UpdateVacation(gmail.UserID, settings).Do()
+	if err != nil {
+		return fmt.Errorf("error enabling vacation responder: %w", err)
+	}
+
+	success("Vacation responder enabled")
+	return nil
+}
+
+func runVacationStatus(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	service, err := gmail.GetService(ctx)
+	if err != nil {
+		return err
+	}
+
+	settings, err := service.Users.Settings.GetVacation(gmail.UserID).Do()
+	if err != nil {
+		return fmt.Errorf("error getting vacation settings: %w", err)
+	}
+
+	if !settings.EnableAutoReply {
+		fmt.Println("Vacation responder: disabled")
+		return nil
+	}
+
+	fmt.Println("Vacation responder: enabled")
+	fmt.Printf("Subject: %s\n", settings.ResponseSubject)
+	if settings.StartTime != 0 {
+		fmt.Printf("Start: %s\n", time.UnixMilli(settings.StartTime).Format(time.RFC3339))
+	}
+	if settings.EndTime != 0 {
+		fmt.Printf("End: %s\n", time.UnixMilli(settings.EndTime).Format(time.RFC3339))
+	}
+
+	responseBody := settings.ResponseBodyPlainText
+	if responseBody == "" {
+		responseBody = settings.ResponseBodyHtml
+	}
+	fmt.Println("\n" + strings.Repeat("=", 80))
+	fmt.Println(responseBody)
+
+	return nil
+}
+
+func runWatch(cmd *cobra.Command, args []string) error {
+	if pollInterval <= 0 {
+		return fmt.Errorf("interval must be positive")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	service, err := gmail.GetService(ctx)
+	if err != nil {
+		return err
+	}
+
+	// The first poll only records what is already there, so that only mail
+	// arriving after startup is reported
+	seen := make(map[string]bool)
+	if _, err := pollNewMessages(ctx, service, seen, true); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Watching for messages matching %q every %s (Ctrl+C to stop)\n", watchQuery, pollInterval)
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			fmt.Fprintf(os.Stderr, "Stopped watching\n")
+			return nil
+		case <-ticker.C:
+		}
+
+		messages, err := pollNewMessages(ctx, service, seen, false)
+		if err != nil {
+			if ctx.Err() != nil {
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+			continue
+		}
+
+		for _, msg := range messages {
+			subject, from := gmail.ExtractHeaders(gmail.MessageHeaders(msg))
+			fmt.Printf("ID: %s\n", msg.Id)
+			fmt.Printf("From: %s\n", from)
+			fmt.Printf("Subject: %s\n", subject)
+			fmt.Println("---")
+
+			if execHook != "" {
+				runExecHook(ctx, msg.Id, from, subject)
+			}
+		}
+	}
+}
+
+// Helper functions
+
+// parseLabelColor parses a "background,text" hex pair and maps each color to
+// the nearest one in Gmail's label palette.
+func parseLabelColor(value string) (*gmailapi.LabelColor, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid --color %q: expected \"#background,#text\"", value)
+	}
+
+	background, err := gmail.NearestLabelColor(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	text, err := gmail.NearestLabelColor(parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.EqualFold(background, strings.TrimSpace(parts[0])) || !strings.EqualFold(text, strings.TrimSpace(parts[1])) {
+		fmt.Fprintf(os.Stderr, "Using nearest Gmail label colors: %s,%s\n", background, text)
+	}
+
+	return &gmailapi.LabelColor{
+		BackgroundColor: background,
+		TextColor:       text,
+	}, nil
+}
+
+// showMessage prints a message fetched by get with tmpl or in the --output
+// format, honoring --fields, --html, --render, --save and
+// --download-attachments.
+func showMessage(service *gmailapi.Service, msg *gmailapi.Message, tmpl *template.Template) error {
+	if tmpl != nil {
+		view := gmail.NewMessageView(service, msg, utcTimes)
+		switch {
+		case messageFormat != "full":
+			view.Body = ""
+		case !rawBody:
+			view.Body = gmail.SanitizeText(view.Body)
+		}
+		if err := tmpl.Execute(os.Stdout, view); err != nil {
+			return fmt.Errorf("error executing template: %w", err)
+		}
+		fmt.Println()
+		if getAttachments {
+			return saveAttachments(service, msg)
+		}
+		return nil
+	}
+
+	if outputFormat == "markdown" {
+		document := markdownMessage(service, msg)
+		if savePath != "" {
+			if err := saveBody(service, msg, document); err != nil {
+				return err
+			}
+		} else if rawBody {
+			fmt.Print(truncateBody(document))
+		} else {
+			fmt.Print(gmail.SanitizeText(truncateBody(document)))
+		}
+		if getAttachments {
+			return saveAttachments(service, msg)
+		}
+		return nil
+	}
+
+	if msg.Payload == nil && messageFormat != "minimal" {
+		fmt.Println("[No headers available]")
+	}
+	for _, header := range selectedHeaders(msg) {
+		fmt.Printf("%s: %s\n", header.Name, header.Value)
+	}
+	// The Date header format depends on the sender; the internal date is
+	// Gmail's own timestamp
+	fmt.Printf("Received: %s\n", gmail.FormatInternalDate(msg.InternalDate, utcTimes))
+	if len(msg.LabelIds) > 0 {
+		fmt.Printf("Labels: %s\n", strings.Join(gmail.LabelNames(service, msg.LabelIds), ", "))
+	}
+	if authResults {
+		fmt.Printf("Authentication: %s\n", gmail.AuthResults(gmail.MessageHeaders(msg)))
+	}
+	if messageFormat != "full" {
+		// metadata and minimal messages have no body or attachment parts
+		return nil
+	}
+
+	body := gmail.GetBody(msg.Payload)
+	if getHTML {
+		body = gmail.GetHTMLBody(msg.Payload)
+		if body == "" {
+			return fmt.Errorf("message has no HTML content")
+		}
+	} else if renderHTML {
+		if html := gmail.GetHTMLBody(msg.Payload); html != "" {
+			body = gmail.HTMLToText(html)
+		}
+	}
+
+	if savePath != "" {
+		if err := saveBody(service, msg, body); err != nil {
+			return err
+		}
+	} else {
+		body = truncateBody(body)
+		// A mislabeled binary part or escape sequences in the body would
+		// garble the terminal
+		if !rawBody {
+			body = gmail.SanitizeText(body)
+		}
+		fmt.Println("\n" + strings.Repeat("=", 80))
+		fmt.Println(body)
+	}
+
+	attachments := gmail.ListAttachments(msg.Payload)
+	if len(attachments) > 0 {
+		fmt.Println(strings.Repeat("=", 80))
+		fmt.Println("Attachments:")
+		for _, a := range attachments {
+			fmt.Printf("  %s (%s, %s)\n", a.Filename, a.MimeType, gmail.FormatSize(a.Size))
+		}
+	}
+
+	fmt.Println(strings.Repeat("=", 80))
+	fmt.Printf("Size: %s, %d attachment(s), %d part(s)\n",
+		gmail.FormatSize(msg.SizeEstimate), len(attachments), gmail.CountParts(msg.Payload))
+
+	if getAttachments {
+		return saveAttachments(service, msg)
+	}
+	return nil
+}
+
+// truncateBody cuts a body printed by get after --max-bytes, on a character
+// boundary, with a marker telling how much was left out.
+func truncateBody(body string) string {
+	if maxBytes <= 0 || len(body) <= maxBytes {
+		return body
+	}
+	end := maxBytes
+	for end > 0 && !utf8.RuneStart(body[end]) {
+		end--
+	}
+	return fmt.Sprintf("%s\n... [truncated, %d more bytes, use --save to get full]\n", body[:end], len(body)-end)
+}
+
+// getFromStdin fetches the messages whose IDs are read from stdin, one per
+// line, and prints each as a JSON object on its own line. Messages that cannot
+// be fetched are reported on stderr and make the command fail at the end.
+func getFromStdin() error {
+	var ids []string
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		if id := strings.TrimSpace(scanner.Text()); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading message IDs: %w", err)
+	}
+
+	service, err := gmail.GetService(context.Background())
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	failed := 0
+	err = gmail.FetchMessages(service, ids, "full", concurrency, func(id string, msg *gmailapi.Message, err error) error {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", gmail.MessageError(id, err))
+			failed++
+			return nil
+		}
+		if err := encoder.Encode(gmail.NewMessageView(service, msg, utcTimes)); err != nil {
+			return err
+		}
+		if getAttachments {
+			return saveAttachments(service, msg)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d messages could not be fetched", failed, len(ids))
+	}
+	return nil
+}
+
+// selectedHeaders returns the headers shown by get, in message order by
+// default or in --fields order.
+func selectedHeaders(msg *gmailapi.Message) []*gmailapi.MessagePartHeader {
+	var headers []*gmailapi.MessagePartHeader
+	if len(getFields) == 0 {
+		for _, header := range gmail.MessageHeaders(msg) {
+			if header.Name == "From" || header.Name == "To" || header.Name == "Subject" || header.Name == "Date" {
+				headers = append(headers, header)
+			}
+		}
+		return headers
+	}
+
+	for _, field := range getFields {
+		for _, header := range gmail.MessageHeaders(msg) {
+			if strings.EqualFold(header.Name, strings.TrimSpace(field)) {
+				headers = append(headers, header)
+			}
+		}
+	}
+	return headers
+}
+
+// markdownMessage renders a message as a markdown document: a header table,
+// a rule, the body and the attachment list. An HTML body is converted to
+// markdown; a plain text one is fenced so its formatting is kept.
+func markdownMessage(service *gmailapi.Service, msg *gmailapi.Message) string {
+	var b strings.Builder
+	cell := strings.NewReplacer("|", "\\|", "\n", " ", "\r", "")
+
+	b.WriteString("| Header | Value |\n|---|---|\n")
+	for _, header := range selectedHeaders(msg) {
+		fmt.Fprintf(&b, "| %s | %s |\n", header.Name, cell.Replace(header.Value))
+	}
+	fmt.Fprintf(&b, "| Received | %s |\n", gmail.FormatInternalDate(msg.InternalDate, utcTimes))
+	if len(msg.LabelIds) > 0 {
+		fmt.Fprintf(&b, "| Labels | %s |\n", cell.Replace(strings.Join(gmail.LabelNames(service, msg.LabelIds), ", ")))
+	}
+	if authResults {
+		fmt.Fprintf(&b, "| Authentication | %s |\n", gmail.AuthResults(gmail.MessageHeaders(msg)))
+	}
+	b.WriteString("\n---\n\n")
+
+	if html := gmail.GetHTMLBody(msg.Payload); html != "" {
+		b.WriteString(gmail.HTMLToMarkdown(html) + "\n")
+	} else {
+		// The fence must be longer than any backtick run in the body
+		fence := "```"
+		body := strings.TrimRight(gmail.GetBody(msg.Payload), "\n")
+		for strings.Contains(body, fence) {
+			fence += "`"
+		}
+		fmt.Fprintf(&b, "%s\n%s\n%s\n", fence, body, fence)
+	}
+
+	if attachments := gmail.ListAttachments(msg.Payload); len(attachments) > 0 {
+		b.WriteString("\n## Attachments\n\n")
+		for _, a := range attachments {
+			fmt.Fprintf(&b, "- %s (%s, %s)\n", a.Filename, a.MimeType, gmail.FormatSize(a.Size))
+		}
+	}
+
+	return b.String()
+}
+
+// messageLines returns the lines compared by diff: the headers (all of them,
+// or those of --fields), a blank line and the decoded text body, or the HTML
+// body rendered as text when there is no text part.
+func messageLines(msg *gmailapi.Message) []string {
+	var lines []string
+	for _, header := range gmail.MessageHeaders(msg) {
+		if len(getFields) == 0 || slices.ContainsFunc(getFields, func(field string) bool {
+			return strings.EqualFold(strings.TrimSpace(field), header.Name)
+		}) {
+			lines = append(lines, header.Name+": "+header.Value)
+		}
+	}
+	lines = append(lines, "")
+
+	body := gmail.GetBody(msg.Payload)
+	if html := gmail.GetHTMLBody(msg.Payload); html != "" && body == "[No text content]" {
+		body = gmail.HTMLToText(html)
+	}
+	body = strings.TrimSuffix(strings.ReplaceAll(body, "\r\n", "\n"), "\n")
+	return append(lines, strings.Split(gmail.SanitizeText(body), "\n")...)
+}
+
+// writeAttachmentToStdout writes the raw bytes of the only attachment of msg
+// matching --include to stdout, keeping status output on stderr so the
+// stream can be piped.
+func writeAttachmentToStdout(service *gmailapi.Service, msg *gmailapi.Message) error {
+	var matches []gmail.Attachment
+	for _, a := range gmail.ListAttachments(msg.Payload) {
+		if a.AttachmentID != "" && gmail.MatchAttachment(a.Filename, includePatterns) {
+			matches = append(matches, a)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return fmt.Errorf("no matching attachment found")
+	case 1:
+	default:
+		names := make([]string, len(matches))
+		for i, a := range matches {
+			names[i] = a.Filename
+		}
+		return fmt.Errorf("--stdout needs exactly one matching attachment, found %d: %s (narrow it with --include)",
+			len(matches), strings.Join(names, ", "))
+	}
+
+	attachment := matches[0]
+	fmt.Fprintf(os.Stderr, "Downloading: %s\n", attachment.Filename)
+	if _, err := gmail.StreamAttachment(service, msg.Id, attachment.AttachmentID, os.Stdout); err != nil {
+		return fmt.Errorf("error downloading attachment %s: %w", attachment.Filename, err)
+	}
+	return nil
+}
+
+// saveAttachments downloads the attachments of msg matching --include to
+// --dir, reusing the already fetched payload.
+func saveAttachments(service *gmailapi.Service, msg *gmailapi.Message) error {
+	// Expand tilde and {date}/{from}/{subject} in download directory
+	dir, err := gmail.ExpandDirTemplate(downloadDir, msg)
+	if err != nil {
+		return err
+	}
+
+	// Create download directory if it doesn't exist
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("error creating download directory: %w", err)
+	}
+
+	// Fail before downloading anything if the files could not be written
+	probe, err := os.CreateTemp(dir, ".email-manager-*")
+	if err != nil {
+		return fmt.Errorf("download directory %s is not writable: %w", dir, err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+
+	// Process attachments
+	attachmentCount := 0
+	if err := gmail.ProcessAttachments(service, msg.Id, msg.Payload, dir, includePatterns, concurrency, preserveStructure, &attachmentCount); err != nil {
+		return err
+	}
+
+	if attachmentCount == 0 {
+		if len(includePatterns) > 0 {
+			fmt.Fprintf(os.Stderr, "No matching attachments found\n")
+			return nil
+		}
+		fmt.Fprintf(os.Stderr, "No attachments found\n")
+		return nil
+	}
+
+	success("Downloaded %d attachment(s) to %s", attachmentCount, dir)
+	return nil
+}
+
+// saveBody writes a message body to --save. When --save is a directory, the
+// file is named after the message date and subject. HTML bodies get their
+// inline images written alongside so the saved page renders offline.
+func saveBody(service *gmailapi.Service, msg *gmailapi.Message, body string) error {
+	path, err := gmail.ExpandTilde(savePath)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		path = filepath.Join(path, savedFileName(msg, body))
+	}
+
+	if getHTML {
+		var count int
+		body, count, err = gmail.SaveInlineImages(service, msg.Id, msg.Payload, body, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			success("Saved %d inline image(s) to %s", count, filepath.Dir(path))
+		}
+	}
+
+	if err := os.WriteFile(path, []byte(body), 0644); err != nil {
+		return fmt.Errorf("error writing file %s: %w", path, err)
+	}
+
+	success("Body saved to %s", path)
+	return nil
+}
+
+// savedFileName names the file saveBody writes into a directory, with the
+// extension of the saved format.
+func savedFileName(msg *gmailapi.Message, body string) string {
+	subject, _ := gmail.ExtractHeaders(gmail.MessageHeaders(msg))
+	ext := ".txt"
+	switch {
+	case messageFormat == "raw":
+		subject, ext = gmail.RawSubject([]byte(body)), ".eml"
+	case outputFormat == "markdown":
+		ext = ".md"
+	case getHTML:
+		ext = ".html"
+	}
+	return gmail.MessageFileName(msg, subject, ext)
+}
+
+// listMessages prints the details of messages, or a notice when there are
+// none. With --exit-code an empty result fails silently with ErrNoMessages.
+func listMessages(cmd *cobra.Command, service *gmailapi.Service, messages []*gmailapi.Message) error {
+	if len(messages) == 0 {
+		fmt.Fprintf(os.Stderr, "No messages found.\n")
+		if exitCode {
+			cmd.SilenceErrors = true
+			cmd.SilenceUsage = true
+			return ErrNoMessages
+		}
+		return nil
+	}
+
+	opts := listOptions()
+	tmpl, err := parseTemplate()
+	if err != nil {
+		return err
+	}
+	opts.Template = tmpl
+
+	return gmail.ListMessagesWithDetails(service, messages, opts)
+}
+
+// parseTemplate parses --template, reading it from a file when it starts
+// with @. It returns nil when no template is set.
+func parseTemplate() (*template.Template, error) {
+	text := outputTemplate
+	if text == "" {
+		return nil, nil
+	}
+	if path, ok := strings.CutPrefix(text, "@"); ok {
+		path, err := gmail.ExpandTilde(path)
+		if err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading template file: %w", err)
+		}
+		text = strings.TrimSuffix(string(data), "\n")
+	}
+	tmpl, err := template.New("output").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// listOptions builds the list display options from the command line flags.
+func listOptions() gmail.ListOptions {
+	return gmail.ListOptions{
+		SnippetWidth: snippetWidth,
+		Full:         fullFetch,
+		UTC:          utcTimes,
+		Sort:         sortKey,
+		Dedupe:       dedupeThreads,
+		Attachments:  withAttachments,
+		// Only for an interactive terminal, where the line is overwritten
+		Progress: !quiet && isatty.IsTerminal(os.Stdout.Fd()) && isatty.IsTerminal(os.Stderr.Fd()),
+	}
+}
+
+// splitAddresses splits comma-separated address lists into individual
+// addresses, falling back to a plain split when a list is not RFC 5322.
+func splitAddresses(lists ...string) []string {
+	var addresses []string
+	for _, list := range lists {
+		if strings.TrimSpace(list) == "" {
+			continue
+		}
+		parsed, err := mail.ParseAddressList(list)
+		if err != nil {
+			for _, address := range strings.Split(list, ",") {
+				if address = strings.TrimSpace(address); address != "" {
+					addresses = append(addresses, address)
+				}
+			}
+			continue
+		}
+		for _, address := range parsed {
+			if address.Name == "" {
+				addresses = append(addresses, address.Address)
+			} else {
+				addresses = append(addresses, address.String())
+			}
+		}
+	}
+	return addresses
+}
+
+// formatMessageIDs normalizes space or comma separated Message-IDs, adding
+// the angle brackets the headers require when they are missing.
+func formatMessageIDs(value string) string {
+	ids := strings.FieldsFunc(value, func(r rune) bool { return r == ' ' || r == ',' })
+	for i, id := range ids {
+		if !strings.HasPrefix(id, "<") {
+			ids[i] = "<" + strings.TrimSuffix(id, ">") + ">"
+		}
+	}
+	return strings.Join(ids, " ")
+}
+
+// confirm asks a yes/no question on stderr and reads the answer from stdin.
+// Anything but "y" or "yes" (including EOF) counts as no.
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
+
+// queryMessageIDs returns the IDs of all the messages matching q, paging
+// through the results.
+func queryMessageIDs(ctx context.Context, service *gmailapi.Service, q string) ([]string, error) {
+	var messageIDs []string
+	err := service.Users.Messages.List(gmail.UserID).Q(q).MaxResults(500).Pages(ctx, func(response *gmailapi.ListMessagesResponse) error {
+		for _, msg := range response.Messages {
+			messageIDs = append(messageIDs, msg.Id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing messages: %w", err)
+	}
+	return messageIDs, nil
+}
+
+// printMessageSample prints the date, sender and subject of the first
+// bulkSampleSize messages on stderr, so the user sees what a bulk action
+// is about to affect.
+func printMessageSample(service *gmailapi.Service, messageIDs []string) error {
+	sample := messageIDs[:min(bulkSampleSize, len(messageIDs))]
+	err := gmail.FetchMessages(service, sample, "metadata", 8, func(id string, msg *gmailapi.Message, err error) error {
+		if err != nil {
+			// Deleted since it was listed
+			return nil
+		}
+		subject, from := gmail.ExtractHeaders(gmail.MessageHeaders(msg))
+		date := time.UnixMilli(msg.InternalDate).Format("2006-01-02")
+		fmt.Fprintf(os.Stderr, "  %s  %s  %s\n", date, gmail.Truncate(gmail.SanitizeText(from), 40), gmail.SanitizeText(subject))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(messageIDs) > len(sample) {
+		fmt.Fprintf(os.Stderr, "  ... and %d more\n", len(messageIDs)-len(sample))
+	}
+	return nil
+}
+
+// readRecipients reads a mail merge CSV file. The header row names the
+// template variables and must include an "email" column.
+func readRecipients(path string) ([]map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening recipients file: %w", err)
+	}
+	defer f.Close()
+
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("error reading recipients file %s: %w", path, err)
+	}
+	if len(rows) < 2 {
+		return nil, fmt.Errorf("recipients file %s has no recipients", path)
+	}
+
+	header := rows[0]
+	hasEmail := false
+	for i, name := range header {
+		header[i] = strings.TrimSpace(name)
+		if strings.EqualFold(header[i], "email") {
+			header[i] = "email"
+			hasEmail = true
+		}
+	}
+	if !hasEmail {
+		return nil, fmt.Errorf("recipients file %s has no email column", path)
+	}
+
+	recipients := make([]map[string]string, 0, len(rows)-1)
+	for _, row := range rows[1:] {
+		recipient := make(map[string]string, len(header))
+		for i, name := range header {
+			recipient[name] = strings.TrimSpace(row[i])
+		}
+		recipients = append(recipients, recipient)
+	}
+
+	return recipients, nil
+}
+
+// trackingHTML returns body as an HTML document ending with the
+// --tracking-pixel image, or an empty string without --tracking-pixel.
+func trackingHTML(body string) string {
+	if trackingPixel == "" {
+		return ""
+	}
+	return gmail.TextToHTML(body, trackingPixel)
+}
+
+// readSignature returns the contents of --signature-file, or an empty string
+// when no signature is configured.
+func readSignature() (string, error) {
+	if signatureFile == "" {
+		return "", nil
+	}
+	path, err := gmail.ExpandTilde(signatureFile)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading signature file: %w", err)
+	}
+	return string(data), nil
+}
+
+// sendMailMerge sends a personalized copy of the message to each recipient of
+// --recipients-file, rendering the subject and body as Go templates with the
+// row's columns (e.g. {{.name}}). The signature is appended after rendering.
+func sendMailMerge(service *gmailapi.Service, signature string, attachments []string) error {
+	recipients, err := readRecipients(recipientsFile)
+	if err != nil {
+		return err
+	}
+
+	subjectTmpl, err := template.New("subject").Option("missingkey=error").Parse(subject)
+	if err != nil {
+		return fmt.Errorf("invalid subject template: %w", err)
+	}
+	bodyTmpl, err := template.New("body").Option("missingkey=error").Parse(body)
+	if err != nil {
+		return fmt.Errorf("invalid body template: %w", err)
+	}
+
+	status := "Sent"
+	if dryRun {
+		status = "Built"
+	}
+
+	failed := 0
+	for i, recipient := range recipients {
+		if i > 0 && sendDelay > 0 && !dryRun {
+			time.Sleep(sendDelay)
+		}
+
+		address := recipient["email"]
+		id, err := sendMerged(service, subjectTmpl, bodyTmpl, signature, attachments, recipient)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s %s: %v\n", red("FAILED"), address, err)
+			failed++
+			continue
+		}
+		if id != "" {
+			fmt.Fprintf(os.Stderr, "%s %s (%s)\n", green(status), address, id)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s %s\n", green(status), address)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Mail merge complete: %d sent, %d failed\n", len(recipients)-failed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d message(s) failed to send", failed, len(recipients))
+	}
+	return nil
+}
+
+// sendMerged renders the templates for one recipient and sends the result,
+// returning the sent message ID.
+func sendMerged(service *gmailapi.Service, subjectTmpl, bodyTmpl *template.Template, signature string, attachments []string, recipient map[string]string) (string, error) {
+	if recipient["email"] == "" {
+		return "", fmt.Errorf("empty email address")
+	}
+
+	var renderedSubject, renderedBody strings.Builder
+	if err := subjectTmpl.Execute(&renderedSubject, recipient); err != nil {
+		return "", fmt.Errorf("error rendering subject: %w", err)
+	}
+	if err := bodyTmpl.Execute(&renderedBody, recipient); err != nil {
+		return "", fmt.Errorf("error rendering body: %w", err)
+	}
+
+	email := &gmail.Email{
+		To:          recipient["email"],
+		Cc:          strings.Join(cc, ", "),
+		Bcc:         strings.Join(bcc, ", "),
+		ReplyTo:     replyTo,
+		Subject:     renderedSubject.String(),
+		Body:        gmail.AppendSignature(gmail.WrapText(renderedBody.String(), wrapWidth), signature),
+		Attachments: attachments,
+		Priority:    priority,
+	}
+	email.HTML = trackingHTML(email.Body)
+
+	return deliver(service, email)
+}
+
+// reply answers a message, to its sender only or to everyone when all is set.
+func reply(messageID string, all bool) error {
+	ctx := context.Background()
+	service, err := gmail.GetService(ctx)
+	if err != nil {
+		return err
+	}
+
+	original, err := service.Users.Messages.Get(gmail.UserID, messageID).Do()
+	if err != nil {
+		return gmail.MessageError(messageID, err)
+	}
+
+	profile, err := service.Users.GetProfile(gmail.UserID).Do()
+	if err != nil {
+		return fmt.Errorf("error getting profile: %w", err)
+	}
+
+	email := gmail.NewReply(original, body, profile.EmailAddress, all)
+	if email.To == "" {
+		return fmt.Errorf("message has no recipient to reply to")
+	}
+	email.Attachments = attach
+	if noThread {
+		email.InReplyTo, email.References, email.ThreadID = "", "", ""
+	}
+
+	id, err := deliver(service, email)
+	if err != nil {
+		return err
+	}
+
+	if !dryRun {
+		success("Reply sent to %s", strings.Join(splitAddresses(email.To, email.Cc), ", "))
+		fmt.Println(id)
+	}
+	return nil
+}
+
+// deliver sends an email and returns the sent message ID, or prints it along
+// with its size under --dry-run. Unless --force is given, a message identical
+// to one sent or attempted within gmail.SentTTL is refused, so re-running a
+// send that failed after Gmail may have accepted it cannot send it twice.
+func deliver(service *gmailapi.Service, email *gmail.Email) (string, error) {
+	if !dryRun {
+		hash, err := email.Hash()
+		if err != nil {
+			return "", err
+		}
+		if !forceSend {
+			if err := gmail.CheckDuplicate(hash); err != nil {
+				return "", fmt.Errorf("%w (use --force to send it again)", err)
+			}
+		}
+
+		// Recorded before sending: a network error does not mean Gmail
+		// did not accept the message
+		gmail.RecordSend(hash, "")
+		sent, err := gmail.SendEmail(service, email)
+		var apiErr *googleapi.Error
+		switch {
+		case errors.As(err, &apiErr), errors.Is(err, gmail.ErrMessageTooLarge):
+			gmail.ForgetSend(hash)
+			return "", err
+		case err != nil:
+			return "", err
+		}
+		gmail.RecordSend(hash, sent.Id)
+		return sent.Id, nil
+	}
+
+	raw, err := email.Raw()
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Println(string(raw))
+	fmt.Println(strings.Repeat("=", 80))
+	fmt.Fprintf(os.Stderr, "Dry run: message not sent (%s raw, %s encoded)\n",
+		gmail.FormatSize(int64(len(raw))), gmail.FormatSize(int64(len(gmail.EncodeRaw(raw)))))
+	if len(raw) > gmail.MaxMessageSize {
+		fmt.Fprintf(os.Stderr, "Warning: message exceeds Gmail's %s limit and would be rejected\n", gmail.FormatSize(gmail.MaxMessageSize))
+	}
+	return "", nil
+}
+
+// scheduleEmail saves email as a draft and queues it for send-scheduled.
+func scheduleEmail(service *gmailapi.Service, email *gmail.Email, sendAt time.Time) error {
+	draft, err := gmail.CreateDraft(service, email)
+	if err != nil {
+		return err
+	}
+
+	queue, err := gmail.LoadSchedule()
+	if err != nil {
+		return err
+	}
+	queue = append(queue, gmail.ScheduledSend{
+		DraftID: draft.Id,
+		SendAt:  sendAt,
+		To:      email.To,
+		Subject: email.Subject,
+		UserID:  gmail.UserID,
+	})
+	if err := gmail.SaveSchedule(queue); err != nil {
+		return err
+	}
+
+	success("Draft %s scheduled for %s", draft.Id, sendAt.Local().Format("2006-01-02 15:04"))
+	fmt.Fprintf(os.Stderr, "It is sent by 'email-manager send-scheduled', which must run periodically (e.g. from cron)\n")
+	return nil
+}
+
+// buildQuery combines a raw Gmail query with the --saved query, the
+// structured search flags and --since, printing the result under --verbose.
+func buildQuery(service *gmailapi.Service, base string) (string, error) {
+	if savedSearch != "" {
+		saved, err := gmail.SavedSearch(savedSearch)
+		if err != nil {
+			return "", err
+		}
+		base = strings.TrimSpace(saved + " " + base)
+	}
+
+	q := gmail.BuildQuery(base, gmail.QueryOptions{
+		From:          from,
+		To:            to,
+		Subject:       subject,
+		HasAttachment: hasAttachment,
+		IsUnread:      isUnread,
+		LargerThan:    largerThan,
+		NewerThan:     newerThan,
+	})
+
+	q, err := withSince(service, q)
+	if err != nil {
+		return "", err
+	}
+
+	if verbose && q != "" {
+		fmt.Fprintf(os.Stderr, "Query: %s\n", q)
+	}
+	return q, nil
+}
+
+// withSince appends an after: token for the date of the --since message to q.
+func withSince(service *gmailapi.Service, q string) (string, error) {
+	if sinceID == "" {
+		return q, nil
+	}
+
+	msg, err := service.Users.Messages.Get(gmail.UserID, sinceID).Format("minimal").Do()
+	if err != nil {
+		return "", fmt.Errorf("error getting --since message: %w", err)
+	}
+
+	// after: has a one second resolution, so the --since message itself
+	// (and others from the same second) can still match
+	after := fmt.Sprintf("after:%d", msg.InternalDate/1000)
+	if q == "" {
+		return after, nil
+	}
+	return q + " " + after, nil
+}
+
+// withoutSince drops the --since message from a listing.
+func withoutSince(messages []*gmailapi.Message) []*gmailapi.Message {
+	if sinceID == "" {
+		return messages
+	}
+
+	kept := messages[:0]
+	for _, msg := range messages {
+		if msg.Id != sinceID {
+			kept = append(kept, msg)
+		}
+	}
+	return kept
+}
+
+// completionService returns a Gmail service for shell completion, or nil when
+// no credentials are stored yet: completion must never start the browser flow.
+func completionService() *gmailapi.Service {
+	if auth.ServiceAccountFile == "" {
+		if _, err := os.Stat(auth.TokenFilePath()); err != nil {
+			return nil
+		}
+	}
+
+	service, err := gmail.GetService(context.Background())
+	if err != nil {
+		return nil
+	}
+	return service
+}
+
+// completeMessageID completes a single message ID argument from the most
+// recent messages.
+func completeMessageID(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 && cmd.Args != nil && cmd.Args(cmd, append(args, toComplete)) != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	service := completionService()
+	if service == nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	response, err := service.Users.Messages.List(gmail.UserID).MaxResults(20).Do()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	ids := make([]string, 0, len(response.Messages))
+	for _, msg := range response.Messages {
+		ids = append(ids, msg.Id)
+	}
+	return ids, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeLabels completes label names, or label IDs described by their
+// names when byID is true.
+func completeLabels(byID bool) ([]string, cobra.ShellCompDirective) {
+	service := completionService()
+	if service == nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	response, err := service.Users.Labels.List(gmail.UserID).Do()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	labels := make([]string, 0, len(response.Labels))
+	for _, label := range response.Labels {
+		if byID {
+			labels = append(labels, label.Id+"\t"+label.Name)
+		} else {
+			labels = append(labels, label.Name)
+		}
+	}
+	return labels, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeContacts completes @group names from groups.conf and addresses
+// from the contacts cache, described by their names. It never scans: run
+// contacts once to fill the cache.
+func completeContacts(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	var addresses []string
+	if groups, err := gmail.Groups(); err == nil {
+		for name, members := range groups {
+			addresses = append(addresses, "@"+name+"\t"+strings.Join(members, ", "))
+		}
+		slices.Sort(addresses)
+	}
+	for _, contact := range gmail.CachedContacts() {
+		if contact.Name != "" {
+			addresses = append(addresses, contact.Address+"\t"+contact.Name)
+		} else {
+			addresses = append(addresses, contact.Address)
+		}
+	}
+	return addresses, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeSavedSearches completes the names of the saved searches, described
+// by their queries.
+func completeSavedSearches(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	searches, err := gmail.SavedSearches()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	names := make([]string, 0, len(searches))
+	for name, q := range searches {
+		names = append(names, name+"\t"+q)
+	}
+	slices.Sort(names)
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+// parseDate parses a date given either as YYYY-MM-DD (local midnight) or RFC3339.
+func parseDate(value string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// parseSchedule parses a --schedule value given either as a duration from now
+// or as a time (YYYY-MM-DD HH:MM in local time, or RFC3339), which must be in
+// the future.
+func parseSchedule(value string) (time.Time, error) {
+	var t time.Time
+	if d, err := time.ParseDuration(value); err == nil {
+		t = time.Now().Add(d)
+	} else if t, err = time.ParseInLocation("2006-01-02 15:04", value, time.Local); err != nil {
+		if t, err = time.Parse(time.RFC3339, value); err != nil {
+			return time.Time{}, fmt.Errorf("invalid --schedule %q: use a duration (2h) or a time (2006-01-02 15:04, RFC3339)", value)
+		}
+	}
+	if !t.After(time.Now()) {
+		return time.Time{}, fmt.Errorf("invalid --schedule %q: time is in the past", value)
+	}
+	return t, nil
+}
+
+// pollNewMessages lists messages matching --query and returns the details of
+// those not yet present in seen, recording them as seen. When prime is true the
+// messages are only recorded and nothing is returned.
+func pollNewMessages(ctx context.Context, service *gmailapi.Service, seen map[string]bool, prime bool) ([]*gmailapi.Message, error) {
+	call := service.Users.Messages.List(gmail.UserID).MaxResults(watchMax).Context(ctx)
+	if watchQuery != "" {
+		call = call.Q(watchQuery)
+	}
+
+	response, err := call.Do()
+	if err != nil {
+		return nil, fmt.Errorf("error listing messages: %w", err)
+	}
+
+	var messages []*gmailapi.Message
+	// The API returns newest first; report oldest first
+	for i := len(response.Messages) - 1; i >= 0; i-- {
+		id := response.Messages[i].Id
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if prime {
+			continue
+		}
+
+		msg, err := service.Users.Messages.Get(gmail.UserID, id).Format("metadata").MetadataHeaders("From", "Subject").Context(ctx).Do()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to get message %s: %v\n", id, err)
+			continue
+		}
+		messages = append(messages, msg)
+	}
+
+	return messages, nil
+}
+
+// runExecHook runs the --exec shell command for a new message, exposing the
+// message details through EMAIL_ID, EMAIL_FROM and EMAIL_SUBJECT.
+func runExecHook(ctx context.Context, id, from, subject string) {
+	hook := exec.CommandContext(ctx, "sh", "-c", execHook)
+	hook.Env = append(os.Environ(),
+		"EMAIL_ID="+id,
+		"EMAIL_FROM="+from,
+		"EMAIL_SUBJECT="+subject,
+	)
+	hook.Stdout = os.Stdout
+	hook.Stderr = os.Stderr
+
+	if err := hook.Run(); err != nil && ctx.Err() == nil {
+		fmt.Fprintf(os.Stderr, "Warning: exec hook failed for message %s: %v\n", id, err)
+	}
+}
+
 // Suppress unused variable warnings for color functions
 var _ = cyan
 var _ = green
@@ -0,0 +1,220 @@
+package cli
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	gmailapi "google.golang.org/api/gmail/v1"
+)
+
+// initOnce registers the commands and flags once for all tests, as Init
+// cannot be called twice.
+var initOnce sync.Once
+
+func initCommands(t *testing.T) {
+	t.Helper()
+	initOnce.Do(Init)
+}
+
+// captureStdout returns what fn prints on stdout.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	done := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		done <- string(data)
+	}()
+	fn()
+	w.Close()
+	return <-done
+}
+
+func TestSharedFlagDefaults(t *testing.T) {
+	initCommands(t)
+
+	// Commands sharing a flag variable must not inherit the default of the
+	// last one registered
+	if query != "" {
+		t.Errorf("query = %q after Init, want empty (list and filters create default)", query)
+	}
+	if maxResults != 10 {
+		t.Errorf("maxResults = %d after Init, want 10", maxResults)
+	}
+	if watchQuery != "is:unread" {
+		t.Errorf("watchQuery = %q after Init, want is:unread", watchQuery)
+	}
+
+	for _, tt := range []struct {
+		name, flag, want string
+	}{
+		{"list", "query", ""},
+		{"filters create", "query", ""},
+		{"watch", "query", "is:unread"},
+		{"list", "max", "10"},
+		{"search", "max", "10"},
+		{"trash list", "max", "10"},
+		{"watch", "max", "10"},
+	} {
+		cmd, _, err := RootCmd.Find(strings.Fields(tt.name))
+		if err != nil {
+			t.Fatalf("finding %s: %v", tt.name, err)
+		}
+		if got := cmd.Flags().Lookup(tt.flag).DefValue; got != tt.want {
+			t.Errorf("%s --%s default = %q, want %q", tt.name, tt.flag, got, tt.want)
+		}
+	}
+}
+
+func TestShowMessage(t *testing.T) {
+	initCommands(t)
+
+	tests := []struct {
+		name string
+		msg  *gmailapi.Message
+		want []string
+	}{
+		{
+			name: "no payload",
+			msg:  &gmailapi.Message{Id: "m1"},
+			want: []string{"[No headers available]", "[No content available]"},
+		},
+		{
+			name: "headers",
+			msg: &gmailapi.Message{
+				Id: "m2",
+				Payload: &gmailapi.MessagePart{
+					MimeType: "text/plain",
+					Headers: []*gmailapi.MessagePartHeader{
+						{Name: "From", Value: "alice@example.com"},
+						{Name: "Subject", Value: "Hello"},
+					},
+					Body: &gmailapi.MessagePartBody{Data: base64.URLEncoding.EncodeToString([]byte("Hi there"))},
+				},
+			},
+			want: []string{"From: alice@example.com", "Subject: Hello", "Hi there"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			out := captureStdout(t, func() {
+				err = showMessage(nil, tt.msg, nil)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("output lacks %q:\n%s", want, out)
+				}
+			}
+		})
+	}
+}
+
+func TestReplyFlags(t *testing.T) {
+	initCommands(t)
+	// No credentials: the handler fails when authenticating, after the
+	// flags were parsed
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("XDG_DATA_HOME", dir)
+	t.Setenv("GMAIL_CREDENTIALS_JSON", "")
+	t.Setenv("GMAIL_TOKEN_JSON", "")
+
+	for _, name := range []string{"reply", "reply-all"} {
+		t.Run(name, func(t *testing.T) {
+			handlerRan, body = false, ""
+			RootCmd.SetArgs([]string{name, "m1", "--body", "Thanks"})
+			RootCmd.SetOut(io.Discard)
+			RootCmd.SetErr(io.Discard)
+			err := RootCmd.Execute()
+			if err != nil && strings.Contains(err.Error(), "unknown flag") {
+				t.Fatalf("%s --body: %v", name, err)
+			}
+			if !handlerRan {
+				t.Errorf("%s handler did not run: %v", name, err)
+			}
+			if body != "Thanks" {
+				t.Errorf("body = %q, want Thanks", body)
+			}
+		})
+	}
+}
+
+func TestNegativeMax(t *testing.T) {
+	initCommands(t)
+	defer func() { maxResults = 10 }()
+
+	for _, args := range [][]string{
+		{"list", "--max", "-1"},
+		{"search", "x", "--max", "-1"},
+		{"trash", "list", "--max", "-1"},
+	} {
+		t.Run(strings.Join(args, " "), func(t *testing.T) {
+			handlerRan = false
+			RootCmd.SetArgs(args)
+			RootCmd.SetOut(io.Discard)
+			RootCmd.SetErr(io.Discard)
+			if code := ExitCode(Execute()); code != ExitUsage {
+				t.Errorf("exit code = %d, want %d", code, ExitUsage)
+			}
+		})
+	}
+}
+
+func TestSendRerunAttachURL(t *testing.T) {
+	initCommands(t)
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	defer func() { attach, attachURLs, dryRun = []string{}, []string{}, false }()
+
+	downloads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads++
+		io.WriteString(w, "report")
+	}))
+	defer server.Close()
+
+	handlerRan, rerun = false, nil
+	RootCmd.SetArgs([]string{"send", "--to", "alice@example.com", "--subject", "Report", "--body", "Hi",
+		"--attach-url", server.URL + "/report.txt", "--dry-run"})
+	RootCmd.SetOut(io.Discard)
+	RootCmd.SetErr(io.Discard)
+	var err error
+	captureStdout(t, func() { err = RootCmd.Execute() })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A re-authorized run calls the handler again with the same globals
+	out := captureStdout(t, func() { err = rerun() })
+	if err != nil {
+		t.Fatalf("rerun: %v", err)
+	}
+	if len(attach) != 0 {
+		t.Errorf("attach = %v after send, want it unchanged", attach)
+	}
+	if downloads != 2 {
+		t.Errorf("downloads = %d, want one per run", downloads)
+	}
+	if n := strings.Count(out, "filename=report.txt"); n != 1 {
+		t.Errorf("rerun message has %d report.txt attachments, want 1:\n%s", n, out)
+	}
+}
@@ -0,0 +1,145 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"slices"
+)
+
+// diffLine is one line of an edit script: kind is ' ' for a line in both
+// texts, '-' for a line only in the first and '+' for a line only in the
+// second. a and b count the lines of each text that come before it.
+type diffLine struct {
+	kind byte
+	text string
+	a, b int
+}
+
+// diffLines returns the shortest edit script turning a into b, computed with
+// Myers' algorithm.
+func diffLines(a, b []string) []diffLine {
+	n, m := len(a), len(b)
+	offset := n + m + 1
+	v := make([]int, 2*(n+m)+3)
+	var trace [][]int
+
+search:
+	for d := 0; d <= n+m; d++ {
+		trace = append(trace, slices.Clone(v))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	// Walk back through the trace from the end of both texts
+	var script []diffLine
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			script = append(script, diffLine{kind: ' ', text: a[x], a: x, b: y})
+		}
+		if x == prevX {
+			y--
+			script = append(script, diffLine{kind: '+', text: b[y], a: x, b: y})
+		} else {
+			x--
+			script = append(script, diffLine{kind: '-', text: a[x], a: x, b: y})
+		}
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		script = append(script, diffLine{kind: ' ', text: a[x], a: x, b: y})
+	}
+
+	slices.Reverse(script)
+	return script
+}
+
+// writeUnifiedDiff writes the differences between a and b in unified diff
+// format with the given number of context lines, coloring removed and added
+// lines. It reports whether the texts differ.
+func writeUnifiedDiff(w io.Writer, nameA, nameB string, a, b []string, context int) bool {
+	script := diffLines(a, b)
+	if !slices.ContainsFunc(script, func(line diffLine) bool { return line.kind != ' ' }) {
+		return false
+	}
+
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", nameA, nameB)
+	for i := 0; i < len(script); {
+		if script[i].kind == ' ' {
+			i++
+			continue
+		}
+
+		// Changes separated by less than two contexts share a hunk
+		last := i
+		for j := i; j < len(script) && j-last <= 2*context; j++ {
+			if script[j].kind != ' ' {
+				last = j
+			}
+		}
+		start := max(i-context, 0)
+		end := min(last+context+1, len(script))
+
+		var countA, countB int
+		for _, line := range script[start:end] {
+			if line.kind != '+' {
+				countA++
+			}
+			if line.kind != '-' {
+				countB++
+			}
+		}
+		fmt.Fprintf(w, "%s\n", cyan(fmt.Sprintf("@@ -%s +%s @@",
+			hunkRange(script[start].a, countA), hunkRange(script[start].b, countB))))
+		for _, line := range script[start:end] {
+			switch line.kind {
+			case '-':
+				fmt.Fprintln(w, red("-"+line.text))
+			case '+':
+				fmt.Fprintln(w, green("+"+line.text))
+			default:
+				fmt.Fprintln(w, " "+line.text)
+			}
+		}
+		i = end
+	}
+	return true
+}
+
+// hunkRange formats the start line and length of one side of a hunk. An
+// empty range starts at the line before it, as in diff -u.
+func hunkRange(before, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", before)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", before+1)
+	}
+	return fmt.Sprintf("%d,%d", before+1, count)
+}
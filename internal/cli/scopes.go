@@ -0,0 +1,58 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"slices"
+
+	"email-manager/pkg/auth"
+
+	"github.com/spf13/cobra"
+)
+
+// scopesAnnotation is the cobra annotation holding the scopes preset a
+// command needs. Commands without it (help, completion) are not checked.
+const scopesAnnotation = "scopes"
+
+// scopesPresetOrder ranks the --scopes presets from least to most privileged.
+var scopesPresetOrder = []string{"readonly", "modify", "full"}
+
+// validateScopesPreset returns an error for an unknown --scopes.
+func validateScopesPreset() error {
+	if !slices.Contains(scopesPresetOrder, auth.ScopePreset) {
+		return fmt.Errorf("invalid --scopes %q: use readonly, modify or full", auth.ScopePreset)
+	}
+	return nil
+}
+
+// warnMissingScopes warns when the saved token was granted a less
+// privileged preset than cmd needs, before the API rejects the requests.
+// Tokens whose scopes were not recorded are not checked.
+func warnMissingScopes(cmd *cobra.Command) {
+	need := cmd.Annotations[scopesAnnotation]
+	if cmd == purgeCmd && permanentDelete {
+		need = "full"
+	}
+	have := auth.TokenPreset()
+	if need == "" || have == "" {
+		return
+	}
+	if slices.Index(scopesPresetOrder, have) < slices.Index(scopesPresetOrder, need) {
+		fmt.Fprintf(os.Stderr, "Warning: %s needs the %s scopes but the token was granted %s; delete %s and run again with --scopes %s\n",
+			cmd.CommandPath(), need, have, auth.TokenFilePath(), need)
+	}
+}
+
+// setupScopes annotates each command with the scopes preset it needs.
+func setupScopes() {
+	presets := map[string][]*cobra.Command{
+		"readonly": {contactsCmd, diffCmd, downloadAttachmentsCmd, getCmd, historyCmd, listCmd, listFiltersCmd, listLabelsCmd, searchCmd, syncCmd, trashListCmd, vacationStatusCmd, watchCmd},
+		"modify":   {applyLabelCmd, archiveCmd, browseCmd, cleanupSenderCmd, createFilterCmd, createLabelCmd, deleteCmd, deleteFilterCmd, importCmd, importantCmd, insertCmd, modifyCmd, moveCmd, muteCmd, notImportantCmd, purgeCmd, readCmd, replyAllCmd, replyCmd, resendCmd, sendCmd, sendScheduledCmd, unreadCmd, unsubscribeCmd, untrashCmd, vacationOffCmd, vacationSetCmd},
+		"full":     {trashEmptyCmd},
+	}
+	for preset, cmds := range presets {
+		for _, cmd := range cmds {
+			cmd.Annotations = map[string]string{scopesAnnotation: preset}
+		}
+	}
+}
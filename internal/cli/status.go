@@ -0,0 +1,33 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+)
+
+// statusPrefixes are the prefixes of the confirmation messages for each
+// --status-style. The silent style prints none.
+var statusPrefixes = map[string]string{
+	"plain": "",
+	"emoji": "✅ ",
+	"ascii": "[OK] ",
+}
+
+// validateStatusStyle returns an error for an unknown --status-style.
+func validateStatusStyle() error {
+	if _, ok := statusPrefixes[statusStyle]; !ok && statusStyle != "silent" {
+		return fmt.Errorf("invalid --status-style %q: use plain, emoji, ascii or silent", statusStyle)
+	}
+	return nil
+}
+
+// success prints the confirmation of a completed action on stderr in the
+// --status-style. Warnings and errors are not confirmations and are printed
+// whatever the style.
+func success(format string, args ...any) {
+	if statusStyle == "silent" {
+		return
+	}
+	fmt.Fprint(os.Stderr, statusPrefixes[statusStyle])
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+}
@@ -0,0 +1,148 @@
+package gmail
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// apiClient is the authenticated HTTP client of the service returned by
+// GetService, used for requests the generated client cannot stream.
+var apiClient *http.Client
+
+// StreamAttachment downloads the attachment with the given ID and writes its
+// decoded content to w, returning the number of bytes written. The generated
+// client would hold the whole base64 response in memory, so the request is
+// made directly and the data field is decoded as it is read.
+func StreamAttachment(service *gmail.Service, messageID, attachmentID string, w io.Writer) (int64, error) {
+	if apiClient == nil {
+		return 0, fmt.Errorf("no authenticated client")
+	}
+
+	endpoint := fmt.Sprintf("%sgmail/v1/users/%s/messages/%s/attachments/%s?alt=json&fields=data",
+		service.BasePath, url.PathEscape(UserID), url.PathEscape(messageID), url.PathEscape(attachmentID))
+	resp, err := apiClient.Get(endpoint)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return 0, err
+	}
+
+	body := bufio.NewReader(resp.Body)
+	if err := seekJSONString(body, "data"); err != nil {
+		return 0, err
+	}
+	// The data cannot be decoded twice while streaming, so instead of trying
+	// each base64 variant like DecodeData it is normalized to unpadded
+	// base64url, which covers them all
+	return io.Copy(w, base64.NewDecoder(base64.RawURLEncoding, &base64URLReader{r: &jsonStringValue{r: body}}))
+}
+
+// base64URLReader converts standard base64 to unpadded base64url as it is
+// read: + and / become - and _, and padding is dropped.
+type base64URLReader struct {
+	r io.Reader
+}
+
+func (b *base64URLReader) Read(p []byte) (int, error) {
+	for {
+		n, err := b.r.Read(p)
+		kept := 0
+		for _, c := range p[:n] {
+			switch c {
+			case '=':
+				continue
+			case '+':
+				c = '-'
+			case '/':
+				c = '_'
+			}
+			p[kept] = c
+			kept++
+		}
+		// A read of only padding must not look like the end of the data
+		if kept > 0 || err != nil {
+			return kept, err
+		}
+	}
+}
+
+// seekJSONString advances r past the opening quote of the string value of
+// field. The response only has the requested field, so the first occurrence
+// of its quoted name is the key.
+func seekJSONString(r *bufio.Reader, field string) error {
+	key := `"` + field + `"`
+	for matched := 0; matched < len(key); {
+		b, err := r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("no %s field in response", field)
+		}
+		switch {
+		case b == key[matched]:
+			matched++
+		case b == key[0]:
+			matched = 1
+		default:
+			matched = 0
+		}
+	}
+
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("no %s value in response", field)
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n', ':':
+		case '"':
+			return nil
+		default:
+			return fmt.Errorf("%s is not a string in response", field)
+		}
+	}
+}
+
+// jsonStringValue reads a JSON string value up to its closing quote. Base64
+// data never needs escaping, so escapes are rejected rather than decoded.
+type jsonStringValue struct {
+	r    *bufio.Reader
+	done bool
+}
+
+func (v *jsonStringValue) Read(p []byte) (int, error) {
+	if v.done {
+		return 0, io.EOF
+	}
+
+	n := 0
+	for n < len(p) {
+		b, err := v.r.ReadByte()
+		if err == io.EOF {
+			return n, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return n, err
+		}
+		switch b {
+		case '"':
+			v.done = true
+			if n == 0 {
+				return 0, io.EOF
+			}
+			return n, nil
+		case '\\':
+			return n, fmt.Errorf("unexpected escape in attachment data")
+		}
+		p[n] = b
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,141 @@
+package gmail
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"email-manager/pkg/auth"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// ContactsCacheTTL is how long the contacts scanned from sent mail are used
+// before the contacts command scans again.
+const ContactsCacheTTL = 24 * time.Hour
+
+// Contact is an address found in the recipients of sent messages.
+type Contact struct {
+	Address string `json:"address"`
+	// Name is the most recent display name used for the address.
+	Name string `json:"name,omitempty"`
+	// Count is the number of sent messages addressed to it.
+	Count int `json:"count"`
+}
+
+// contactsCache is the on-disk form of the cached contacts.
+type contactsCache struct {
+	Fetched  time.Time `json:"fetched"`
+	Contacts []Contact `json:"contacts"`
+}
+
+// Contacts returns the To, Cc and Bcc recipients of the last scan sent
+// messages, most frequent first. The result is cached for ContactsCacheTTL;
+// refresh scans again regardless.
+func Contacts(service *gmail.Service, scan int64, refresh bool) ([]Contact, error) {
+	if !refresh {
+		if contacts, fetched, ok := loadContactsCache(); ok && time.Since(fetched) < ContactsCacheTTL {
+			return contacts, nil
+		}
+	}
+
+	var ids []string
+	call := service.Users.Messages.List(UserID).Q("in:sent")
+	for int64(len(ids)) < scan {
+		response, err := call.MaxResults(min(scan-int64(len(ids)), 500)).Do()
+		if err != nil {
+			return nil, fmt.Errorf("error listing sent messages: %w", err)
+		}
+		for _, msg := range response.Messages {
+			ids = append(ids, msg.Id)
+		}
+		if response.NextPageToken == "" {
+			break
+		}
+		call.PageToken(response.NextPageToken)
+	}
+
+	byAddress := make(map[string]*Contact)
+	var contacts []*Contact
+	err := FetchMessages(service, ids, "metadata", 8, func(id string, msg *gmail.Message, err error) error {
+		if err != nil {
+			// Deleted since it was listed
+			return nil
+		}
+		headers := MessageHeaders(msg)
+		for _, name := range []string{"To", "Cc", "Bcc"} {
+			for _, address := range parseAddresses(headerValue(headers, name)) {
+				key := strings.ToLower(address.Address)
+				contact := byAddress[key]
+				if contact == nil {
+					contact = &Contact{Address: address.Address}
+					byAddress[key] = contact
+					contacts = append(contacts, contact)
+				}
+				// Messages come newest first, so the first name seen is the latest
+				if contact.Name == "" {
+					contact.Name = address.Name
+				}
+				contact.Count++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ranked := make([]Contact, len(contacts))
+	for i, contact := range contacts {
+		ranked[i] = *contact
+	}
+	slices.SortStableFunc(ranked, func(a, b Contact) int {
+		return cmp.Compare(b.Count, a.Count)
+	})
+	saveContactsCache(ranked)
+	return ranked, nil
+}
+
+// CachedContacts returns the contacts of the last scan, however old, without
+// any API call. It is meant for shell completion, which must be fast.
+func CachedContacts() []Contact {
+	contacts, _, _ := loadContactsCache()
+	return contacts
+}
+
+// contactsCachePath returns the contacts cache file of the target mailbox.
+func contactsCachePath() string {
+	return filepath.Join(auth.CacheDir(), "contacts_"+cacheAccount()+".json")
+}
+
+// loadContactsCache returns the cached contacts and when they were scanned.
+func loadContactsCache() ([]Contact, time.Time, bool) {
+	data, err := os.ReadFile(contactsCachePath())
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	var cache contactsCache
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return nil, time.Time{}, false
+	}
+	return cache.Contacts, cache.Fetched, true
+}
+
+// saveContactsCache stores the contacts. Failing to write the cache only
+// costs a scan next time, so errors are ignored.
+func saveContactsCache(contacts []Contact) {
+	data, err := json.Marshal(contactsCache{Fetched: time.Now(), Contacts: contacts})
+	if err != nil {
+		return
+	}
+	path := contactsCachePath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return
+	}
+	_ = os.WriteFile(path, data, 0600)
+}
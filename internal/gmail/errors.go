@@ -0,0 +1,150 @@
+package gmail
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"email-manager/pkg/auth"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// Errors reported for common API failures, matched with errors.Is.
+var (
+	ErrNotAuthenticated  = errors.New("not authenticated")
+	ErrNotFound          = errors.New("not found")
+	ErrMessageNotFound   = errors.New("no such message")
+	ErrRateLimited       = errors.New("rate limited")
+	ErrInsufficientScope = errors.New("insufficient authorization scope")
+	ErrNetwork           = errors.New("network error")
+)
+
+// ClassifyError wraps err with ErrNotAuthenticated, ErrNotFound,
+// ErrRateLimited or ErrInsufficientScope when it comes from a Gmail API
+// response (or a token refresh rejecting the token) with the corresponding
+// status, and with ErrNetwork when no response was received or the token
+// endpoint failed. Other errors are returned unchanged.
+func ClassifyError(err error) error {
+	// A rejected refresh (invalid_grant for a revoked token) reaches the API
+	// call wrapped in a url.Error, so it is checked first. Other token
+	// endpoint failures (5xx, temporarily_unavailable) leave the token valid
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		if tokenRejected(retrieveErr) {
+			return fmt.Errorf("%w: %w", ErrNotAuthenticated, err)
+		}
+		return fmt.Errorf("%w: %w", ErrNetwork, err)
+	}
+
+	// The HTTP client reports failed requests, timeouts included, as url.Error
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return fmt.Errorf("%w: %w", ErrNetwork, err)
+	}
+
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+
+	switch {
+	case apiErr.Code == http.StatusUnauthorized:
+		return fmt.Errorf("%w: %w", ErrNotAuthenticated, err)
+	case apiErr.Code == http.StatusNotFound:
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	case apiErr.Code == http.StatusTooManyRequests, isRateLimit(apiErr):
+		return fmt.Errorf("%w: %w", ErrRateLimited, err)
+	case isInsufficientScope(apiErr):
+		// Typically a token saved before a scope was added to auth.Scopes, or
+		// authorized with a smaller --scopes preset
+		if auth.ServiceAccountFile != "" {
+			return fmt.Errorf("%w: grant the service account all of the Gmail scopes in the admin console: %w", ErrInsufficientScope, err)
+		}
+		return fmt.Errorf("%w: the saved token lacks a required scope (it predates it or a smaller --scopes preset was used), delete %s and run the command again to re-authorize: %w",
+			ErrInsufficientScope, auth.TokenFilePath(), err)
+	}
+	return err
+}
+
+// errorCodes maps the error types to the codes reported by ErrorCode, most
+// specific first.
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrMessageNotFound, "message_not_found"},
+	{ErrLabelNotFound, "label_not_found"},
+	{ErrNotFound, "not_found"},
+	{ErrNotAuthenticated, "not_authenticated"},
+	{ErrRateLimited, "rate_limited"},
+	{ErrInsufficientScope, "insufficient_scope"},
+	{ErrMessageTooLarge, "message_too_large"},
+	{ErrDuplicateSend, "duplicate_send"},
+	{ErrNetwork, "network_error"},
+}
+
+// ErrorCode returns a stable machine-readable code for err, such as
+// "not_found" or "rate_limited", or "error" when it has no specific type.
+func ErrorCode(err error) string {
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	return "error"
+}
+
+// MessageError wraps an error from getting message id, reporting a missing
+// message as ErrMessageNotFound.
+func MessageError(id string, err error) error {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", ErrMessageNotFound, id)
+	}
+	return fmt.Errorf("error getting message: %w", err)
+}
+
+// isRateLimit reports whether a 403 error is a quota error rather than a
+// permission error.
+func isRateLimit(apiErr *googleapi.Error) bool {
+	if apiErr.Code != http.StatusForbidden {
+		return false
+	}
+	for _, item := range apiErr.Errors {
+		if item.Reason == "rateLimitExceeded" || item.Reason == "userRateLimitExceeded" {
+			return true
+		}
+	}
+	return false
+}
+
+// isInsufficientScope reports whether a 403 error is caused by the token
+// missing a scope.
+func isInsufficientScope(apiErr *googleapi.Error) bool {
+	if apiErr.Code != http.StatusForbidden {
+		return false
+	}
+	for _, item := range apiErr.Errors {
+		if item.Reason == "insufficientPermissions" {
+			return true
+		}
+	}
+	return strings.Contains(apiErr.Message, "insufficient authentication scopes")
+}
+
+// tokenRejected reports whether a token endpoint error means the saved token
+// is no longer valid, rather than a transient server failure.
+func tokenRejected(retrieveErr *oauth2.RetrieveError) bool {
+	if retrieveErr.ErrorCode == "invalid_grant" {
+		return true
+	}
+	if retrieveErr.Response == nil {
+		return false
+	}
+	status := retrieveErr.Response.StatusCode
+	return status == http.StatusBadRequest || status == http.StatusUnauthorized
+}
@@ -0,0 +1,36 @@
+package gmail
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestClassifyRetrieveError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  *oauth2.RetrieveError
+		want error
+	}{
+		{"invalid_grant", &oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusBadRequest}, ErrorCode: "invalid_grant"}, ErrNotAuthenticated},
+		{"unauthorized", &oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusUnauthorized}}, ErrNotAuthenticated},
+		{"bad request", &oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusBadRequest}}, ErrNotAuthenticated},
+		{"server error", &oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusServiceUnavailable}}, ErrNetwork},
+		{"temporarily unavailable", &oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusServiceUnavailable}, ErrorCode: "temporarily_unavailable"}, ErrNetwork},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Refresh errors reach the API call wrapped in a url.Error
+			err := ClassifyError(&url.Error{Op: "Get", URL: "https://gmail.googleapis.com/", Err: tt.err})
+			if !errors.Is(err, tt.want) {
+				t.Errorf("ClassifyError = %v, want %v", err, tt.want)
+			}
+			if tt.want == ErrNetwork && errors.Is(err, ErrNotAuthenticated) {
+				t.Errorf("ClassifyError = %v, transient failure reported as not authenticated", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package gmail
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"email-manager/pkg/auth"
+)
+
+// GroupsPath returns the file defining the recipient groups, one
+// name = ["address", ...] per line.
+func GroupsPath() string {
+	return filepath.Join(auth.ConfigDir(), "groups.conf")
+}
+
+// Groups returns the addresses of each recipient group by name, or none when
+// the file does not exist.
+func Groups() (map[string][]string, error) {
+	data, err := os.ReadFile(GroupsPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string][]string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading recipient groups: %w", err)
+	}
+	groups, err := parseGroups(data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", GroupsPath(), err)
+	}
+	return groups, nil
+}
+
+// ExpandGroups replaces each @name entry of a comma-separated recipient list
+// with the addresses of the group. A list without group references is
+// returned unchanged.
+func ExpandGroups(list string) (string, error) {
+	entries := strings.Split(list, ",")
+	if !slices.ContainsFunc(entries, isGroupReference) {
+		return list, nil
+	}
+
+	groups, err := Groups()
+	if err != nil {
+		return "", err
+	}
+	var expanded []string
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !isGroupReference(entry) {
+			if entry != "" {
+				expanded = append(expanded, entry)
+			}
+			continue
+		}
+		addresses, ok := groups[entry[1:]]
+		if !ok {
+			return "", fmt.Errorf("no recipient group %q in %s", entry[1:], GroupsPath())
+		}
+		expanded = append(expanded, addresses...)
+	}
+	return strings.Join(expanded, ", "), nil
+}
+
+// isGroupReference reports whether a recipient list entry names a group.
+func isGroupReference(entry string) bool {
+	entry = strings.TrimSpace(entry)
+	return len(entry) > 1 && entry[0] == '@'
+}
+
+// parseGroups parses name = ["address", ...] lines. Blank lines and lines
+// starting with # are skipped.
+func parseGroups(data []byte) (map[string][]string, error) {
+	groups := make(map[string][]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, list, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		var addresses []string
+		if !ok || name == "" || json.Unmarshal([]byte(strings.TrimSpace(list)), &addresses) != nil || len(addresses) == 0 {
+			return nil, fmt.Errorf("line %d: expected name = [\"address\", ...]", n)
+		}
+		groups[name] = addresses
+	}
+	return groups, scanner.Err()
+}
@@ -0,0 +1,197 @@
+package gmail
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+)
+
+// blockTags are HTML elements rendered as separate paragraphs.
+var blockTags = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true,
+	"div": true, "dl": true, "dt": true, "dd": true, "footer": true,
+	"form": true, "h1": true, "h2": true, "h3": true, "h4": true,
+	"h5": true, "h6": true, "header": true, "hr": true,
+	"main": true, "nav": true, "ol": true, "p": true, "pre": true,
+	"section": true, "table": true, "tr": true, "ul": true,
+}
+
+// skipTags are HTML elements whose content is never rendered.
+var skipTags = map[string]bool{
+	"head": true, "script": true, "style": true, "title": true,
+}
+
+// HTMLToText converts an HTML document to readable plain text: tags are
+// stripped, links are kept as [text](url) and whitespace is collapsed.
+func HTMLToText(document string) string {
+	return renderHTML(document, false)
+}
+
+// HTMLToMarkdown converts an HTML document to markdown: like HTMLToText, with
+// headings rendered as # titles and bold/italic text as **bold** and _italic_.
+func HTMLToMarkdown(document string) string {
+	return renderHTML(document, true)
+}
+
+// headingLevels maps heading elements to their markdown level.
+var headingLevels = map[string]int{"h1": 1, "h2": 2, "h3": 3, "h4": 4, "h5": 5, "h6": 6}
+
+// emphasisMarks maps inline elements to their markdown delimiters.
+var emphasisMarks = map[string]string{"b": "**", "strong": "**", "i": "_", "em": "_"}
+
+func renderHTML(document string, markdown bool) string {
+	r := &textRenderer{}
+	tokenizer := html.NewTokenizer(strings.NewReader(document))
+
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return strings.TrimSpace(r.buf.String())
+
+		case html.TextToken:
+			if r.skip == 0 {
+				r.text(string(tokenizer.Text()))
+			}
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch {
+			case skipTags[token.Data]:
+				if token.Type == html.StartTagToken {
+					r.skip++
+				}
+			case token.Data == "br":
+				r.breakLine(1)
+			case token.Data == "a":
+				r.links = append(r.links, attr(token, "href"))
+				r.write("[")
+			case token.Data == "img":
+				r.text(attr(token, "alt"))
+			case token.Data == "li":
+				r.breakLine(1)
+				r.write("- ")
+			case markdown && headingLevels[token.Data] > 0:
+				r.breakLine(2)
+				r.write(strings.Repeat("#", headingLevels[token.Data]) + " ")
+			case markdown && emphasisMarks[token.Data] != "":
+				r.mark(emphasisMarks[token.Data])
+			case blockTags[token.Data]:
+				r.breakLine(2)
+			}
+
+		case html.EndTagToken:
+			token := tokenizer.Token()
+			switch {
+			case skipTags[token.Data]:
+				if r.skip > 0 {
+					r.skip--
+				}
+			case token.Data == "a":
+				r.closeLink()
+			case token.Data == "li":
+				r.breakLine(1)
+			case markdown && emphasisMarks[token.Data] != "":
+				r.buf.WriteString(emphasisMarks[token.Data])
+				r.newlines = 0
+			case blockTags[token.Data]:
+				r.breakLine(2)
+			}
+		}
+	}
+}
+
+// textRenderer accumulates rendered text while collapsing whitespace.
+type textRenderer struct {
+	buf      strings.Builder
+	skip     int
+	space    bool
+	newlines int
+	links    []string
+	// glue suppresses the space before the next write.
+	glue bool
+}
+
+// text writes s with runs of whitespace collapsed to single spaces.
+func (r *textRenderer) text(s string) {
+	if s == "" {
+		return
+	}
+	if unicode.IsSpace(rune(s[0])) {
+		r.space = true
+	}
+	for i, word := range strings.Fields(s) {
+		if i > 0 {
+			r.space = true
+		}
+		r.write(word)
+	}
+	if unicode.IsSpace(rune(s[len(s)-1])) {
+		r.space = true
+	}
+}
+
+// write appends s, preceded by a pending space unless at the start of a line.
+func (r *textRenderer) write(s string) {
+	if r.space && !r.glue && r.buf.Len() > 0 && r.newlines == 0 && !strings.HasSuffix(r.buf.String(), "[") {
+		r.buf.WriteByte(' ')
+	}
+	r.buf.WriteString(s)
+	r.space = false
+	r.glue = false
+	r.newlines = 0
+}
+
+// breakLine ends the current line, leaving at most n consecutive newlines.
+func (r *textRenderer) breakLine(n int) {
+	for r.buf.Len() > 0 && r.newlines < n {
+		r.buf.WriteByte('\n')
+		r.newlines++
+	}
+	r.space = false
+}
+
+// mark opens an emphasis delimiter, which must directly precede the text.
+func (r *textRenderer) mark(delimiter string) {
+	r.write(delimiter)
+	r.glue = true
+}
+
+func (r *textRenderer) closeLink() {
+	if len(r.links) == 0 {
+		return
+	}
+	href := r.links[len(r.links)-1]
+	r.links = r.links[:len(r.links)-1]
+
+	r.buf.WriteString("]")
+	if href != "" && !strings.HasPrefix(href, "#") {
+		r.buf.WriteString("(" + href + ")")
+	}
+	r.newlines = 0
+}
+
+// attr returns the value of the named attribute of a token.
+func attr(token html.Token, name string) string {
+	for _, a := range token.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// TextToHTML returns a plain text body as an HTML document that keeps its
+// line breaks, ending with a 1x1 image loaded from pixelURL when it is set.
+func TextToHTML(text, pixelURL string) string {
+	var b strings.Builder
+	b.WriteString(`<html><body><div style="white-space: pre-wrap">`)
+	b.WriteString(html.EscapeString(text))
+	b.WriteString("</div>")
+	if pixelURL != "" {
+		fmt.Fprintf(&b, `<img src="%s" width="1" height="1" alt="">`, html.EscapeString(pixelURL))
+	}
+	b.WriteString("</body></html>\r\n")
+	return b.String()
+}
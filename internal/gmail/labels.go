@@ -0,0 +1,296 @@
+package gmail
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"email-manager/pkg/auth"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// ErrLabelNotFound is returned when a label name or ID matches no label.
+var ErrLabelNotFound = errors.New("label not found")
+
+// LabelCacheTTL is how long the cached label list is used before it is
+// fetched again.
+const LabelCacheTTL = time.Hour
+
+// RefreshLabels makes label resolution ignore the cached label list.
+var RefreshLabels bool
+
+// knownLabels holds the labels fetched or loaded from the cache by this
+// process, so LabelNames reads them at most once per run.
+var knownLabels []*gmail.Label
+
+// systemLabelNames are the display names of Gmail's system labels, whose
+// names in Labels.List are the same as their IDs.
+var systemLabelNames = map[string]string{
+	"INBOX":               "Inbox",
+	"UNREAD":              "Unread",
+	"STARRED":             "Starred",
+	"IMPORTANT":           "Important",
+	"SENT":                "Sent",
+	"DRAFT":               "Draft",
+	"SPAM":                "Spam",
+	"TRASH":               "Trash",
+	"CHAT":                "Chat",
+	"CATEGORY_PERSONAL":   "Personal",
+	"CATEGORY_SOCIAL":     "Social",
+	"CATEGORY_PROMOTIONS": "Promotions",
+	"CATEGORY_UPDATES":    "Updates",
+	"CATEGORY_FORUMS":     "Forums",
+}
+
+// labelPalette lists the colors Gmail accepts for label backgrounds and text.
+var labelPalette = []string{
+	"#000000", "#434343", "#666666", "#999999", "#cccccc", "#efefef", "#f3f3f3", "#ffffff",
+	"#fb4c2f", "#ffad47", "#fad165", "#16a766", "#43d692", "#4a86e8", "#a479e2", "#f691b3",
+	"#f6c5be", "#ffe6c7", "#fef1d1", "#b9e4d0", "#c6f3de", "#c9daf8", "#e4d7f5", "#fcdee8",
+	"#efa093", "#ffd6a2", "#fce8b3", "#89d3b2", "#a0eac9", "#a4c2f4", "#d0bcf1", "#fbc8d9",
+	"#e66550", "#ffbc6b", "#fcda83", "#44b984", "#68dfa9", "#6d9eeb", "#b694e8", "#f7a7c0",
+	"#cc3a21", "#eaa041", "#f2c960", "#149e60", "#3dc789", "#3c78d8", "#8e63ce", "#e07798",
+	"#ac2b16", "#cf8933", "#d5ae49", "#0b804b", "#2a9c68", "#285bac", "#653e9b", "#b65775",
+	"#822111", "#a46a21", "#aa8831", "#076239", "#1a764d", "#1c4587", "#41236d", "#83334c",
+	"#464646", "#e7e7e7", "#0d3472", "#b6cff5", "#0d3b44", "#98d7e4", "#3d188e", "#e3d7ff",
+	"#711a36", "#fbd3e0", "#8a1c0a", "#f2b2a8", "#7a2e0b", "#ffc8af", "#7a4706", "#ffdeb5",
+	"#594c05", "#fbe983", "#684e07", "#fdedc1", "#0b4f30", "#b3efd3", "#04502e", "#a2dcc1",
+	"#c2c2c2", "#4986e7", "#2da2bb", "#b99aff", "#994a64", "#f691b2", "#ff7537", "#ffad46",
+	"#662e37", "#ebdbde", "#cca6ac", "#094228", "#42d692", "#16a765",
+}
+
+// NearestLabelColor maps a #rrggbb hex color to the closest color in the
+// palette Gmail accepts for labels.
+func NearestLabelColor(hex string) (string, error) {
+	r, g, b, err := parseHexColor(hex)
+	if err != nil {
+		return "", err
+	}
+
+	best := ""
+	bestDistance := -1
+	for _, candidate := range labelPalette {
+		cr, cg, cb, _ := parseHexColor(candidate)
+		distance := (r-cr)*(r-cr) + (g-cg)*(g-cg) + (b-cb)*(b-cb)
+		if bestDistance < 0 || distance < bestDistance {
+			best = candidate
+			bestDistance = distance
+		}
+	}
+
+	return best, nil
+}
+
+func parseHexColor(hex string) (r, g, b int, err error) {
+	value := strings.TrimPrefix(strings.TrimSpace(hex), "#")
+	if len(value) != 6 {
+		return 0, 0, 0, fmt.Errorf("invalid color %q: expected #rrggbb", hex)
+	}
+
+	rgb, err := strconv.ParseUint(value, 16, 32)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid color %q: expected #rrggbb", hex)
+	}
+
+	return int(rgb >> 16 & 0xff), int(rgb >> 8 & 0xff), int(rgb & 0xff), nil
+}
+
+// ResolveLabelID resolves a label name (case-insensitive) or ID to its label ID.
+func ResolveLabelID(service *gmail.Service, name string) (string, error) {
+	ids, err := ResolveLabelIDs(service, []string{name})
+	if err != nil {
+		return "", err
+	}
+	return ids[0], nil
+}
+
+// ResolveLabelIDs resolves label names (case-insensitive) or IDs to label IDs
+// using a single Labels.List call.
+func ResolveLabelIDs(service *gmail.Service, names []string) ([]string, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	// A name missing from the cache may be a label created since it was saved
+	if !RefreshLabels {
+		if labels, ok := loadLabelCache(); ok {
+			if ids, err := findLabelIDs(labels, names); err == nil {
+				return ids, nil
+			}
+		}
+	}
+
+	response, err := service.Users.Labels.List(UserID).Do()
+	if err != nil {
+		return nil, fmt.Errorf("error listing labels: %w", err)
+	}
+	saveLabelCache(response.Labels)
+	knownLabels = response.Labels
+
+	return findLabelIDs(response.Labels, names)
+}
+
+// GetLabels gets the labels with the given IDs, including their message and
+// thread counts which Labels.List leaves out, running up to concurrency
+// requests at once. The labels are returned in the order of ids.
+func GetLabels(service *gmail.Service, ids []string, concurrency int) ([]*gmail.Label, error) {
+	labels := make([]*gmail.Label, len(ids))
+	errs := make([]error, len(ids))
+	sem := make(chan struct{}, max(concurrency, 1))
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			labels[i], errs[i] = service.Users.Labels.Get(UserID, id).Do()
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("error getting label %s: %w", ids[i], err)
+		}
+	}
+	return labels, nil
+}
+
+// LabelNames maps label IDs to display names: friendly names for system
+// labels and user label names from the label cache, which is refreshed when
+// an ID is missing from it. Labels are only shown, so IDs that cannot be
+// resolved are returned as is rather than failing.
+func LabelNames(service *gmail.Service, ids []string) []string {
+	if knownLabels == nil && !RefreshLabels {
+		knownLabels, _ = loadLabelCache()
+	}
+	if knownLabels == nil || !labelIDsKnown(knownLabels, ids) {
+		if response, err := service.Users.Labels.List(UserID).Do(); err == nil {
+			saveLabelCache(response.Labels)
+			knownLabels = response.Labels
+		}
+	}
+
+	names := make([]string, 0, len(ids))
+	for _, id := range ids {
+		names = append(names, labelName(knownLabels, id))
+	}
+	return names
+}
+
+// labelIDsKnown reports whether every user label in ids is in labels.
+func labelIDsKnown(labels []*gmail.Label, ids []string) bool {
+	for _, id := range ids {
+		if _, ok := systemLabelNames[id]; ok {
+			continue
+		}
+		if !slices.ContainsFunc(labels, func(label *gmail.Label) bool { return label.Id == id }) {
+			return false
+		}
+	}
+	return true
+}
+
+// labelName returns the display name of a label ID, or the ID when unknown.
+func labelName(labels []*gmail.Label, id string) string {
+	if name, ok := systemLabelNames[id]; ok {
+		return name
+	}
+	for _, label := range labels {
+		if label.Id == id {
+			return label.Name
+		}
+	}
+	return id
+}
+
+// findLabelIDs looks up each name in labels.
+func findLabelIDs(labels []*gmail.Label, names []string) ([]string, error) {
+	ids := make([]string, 0, len(names))
+	for _, name := range names {
+		id, ok := findLabelID(labels, name)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrLabelNotFound, name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// findLabelID looks up a label by exact ID first, then by case-insensitive name.
+func findLabelID(labels []*gmail.Label, name string) (string, bool) {
+	for _, label := range labels {
+		if label.Id == name {
+			return label.Id, true
+		}
+	}
+	for _, label := range labels {
+		if strings.EqualFold(label.Name, name) {
+			return label.Id, true
+		}
+	}
+	return "", false
+}
+
+// labelCache is the on-disk form of the cached label list.
+type labelCache struct {
+	Fetched time.Time      `json:"fetched"`
+	Labels  []*gmail.Label `json:"labels"`
+}
+
+// labelCachePath returns the cache file for the target mailbox.
+func labelCachePath() string {
+	return filepath.Join(auth.CacheDir(), "labels_"+cacheAccount()+".json")
+}
+
+// cacheAccount names the target mailbox in cache file names, so --user
+// mailboxes and service account users impersonating different people get
+// separate caches.
+func cacheAccount() string {
+	account := UserID
+	if account == "me" && auth.ServiceAccountFile != "" {
+		account = auth.Impersonate
+	}
+	return strings.NewReplacer("/", "_", "\\", "_").Replace(account)
+}
+
+// loadLabelCache returns the cached labels if the cache exists and is younger
+// than LabelCacheTTL.
+func loadLabelCache() ([]*gmail.Label, bool) {
+	data, err := os.ReadFile(labelCachePath())
+	if err != nil {
+		return nil, false
+	}
+	var cache labelCache
+	if err := json.Unmarshal(data, &cache); err != nil || time.Since(cache.Fetched) > LabelCacheTTL {
+		return nil, false
+	}
+	return cache.Labels, true
+}
+
+// saveLabelCache stores the id and name of labels. Failing to write the cache
+// only costs a Labels.List call next time, so errors are ignored.
+func saveLabelCache(labels []*gmail.Label) {
+	cache := labelCache{Fetched: time.Now()}
+	for _, label := range labels {
+		cache.Labels = append(cache.Labels, &gmail.Label{Id: label.Id, Name: label.Name})
+	}
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return
+	}
+	path := labelCachePath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return
+	}
+	_ = os.WriteFile(path, data, 0600)
+}
@@ -0,0 +1,711 @@
+package gmail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// MaxMessageSize is the largest message Gmail accepts, attachments included.
+const MaxMessageSize = 25 * 1024 * 1024
+
+// AttachURLTimeout bounds the download of a file attached with send
+// --attach-url.
+const AttachURLTimeout = time.Minute
+
+// ErrMessageTooLarge is returned when a message exceeds MaxMessageSize.
+var ErrMessageTooLarge = errors.New("message too large")
+
+// Email describes an outgoing message.
+type Email struct {
+	To      string
+	Cc      string
+	Bcc     string
+	ReplyTo string
+	Subject string
+	Body    string
+	// HTML is sent as a text/html alternative to Body; empty sends plain text
+	// only.
+	HTML string
+	// Attachments are paths of files attached to the message.
+	Attachments []string
+	// InReplyTo and References are the threading headers of a reply.
+	InReplyTo  string
+	References string
+	// ThreadID is the Gmail thread the message is added to.
+	ThreadID string
+	// Priority is "high", "normal" or "low"; empty sends no priority headers.
+	Priority string
+	// Calendar is iCalendar data sent as a meeting invite; empty sends none.
+	Calendar string
+}
+
+// priorityHeaders are the X-Priority, Importance and X-MSMail-Priority values
+// for each priority, as understood by Outlook, Thunderbird and Apple Mail.
+var priorityHeaders = map[string][3]string{
+	"high":   {"1 (Highest)", "high", "High"},
+	"normal": {"3 (Normal)", "normal", "Normal"},
+	"low":    {"5 (Lowest)", "low", "Low"},
+}
+
+// Raw returns the RFC 822 representation of the email. Messages with
+// attachments or an invite are built as multipart/mixed.
+func (e *Email) Raw() ([]byte, error) {
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "To: %s\r\n", e.To)
+	if e.Cc != "" {
+		fmt.Fprintf(&message, "Cc: %s\r\n", e.Cc)
+	}
+	// Gmail takes the envelope recipients from the To, Cc and Bcc headers of
+	// a raw message and removes Bcc from the copies it delivers, keeping it
+	// only in the sender's Sent copy. The header must therefore stay: without
+	// it the Bcc recipients would not receive the message at all.
+	if e.Bcc != "" {
+		fmt.Fprintf(&message, "Bcc: %s\r\n", e.Bcc)
+	}
+	if e.ReplyTo != "" {
+		fmt.Fprintf(&message, "Reply-To: %s\r\n", e.ReplyTo)
+	}
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", e.Subject))
+	if e.InReplyTo != "" {
+		fmt.Fprintf(&message, "In-Reply-To: %s\r\n", e.InReplyTo)
+	}
+	if e.References != "" {
+		fmt.Fprintf(&message, "References: %s\r\n", e.References)
+	}
+	if headers, ok := priorityHeaders[e.Priority]; ok {
+		fmt.Fprintf(&message, "X-Priority: %s\r\n", headers[0])
+		fmt.Fprintf(&message, "Importance: %s\r\n", headers[1])
+		fmt.Fprintf(&message, "X-MSMail-Priority: %s\r\n", headers[2])
+	}
+	message.WriteString("MIME-Version: 1.0\r\n")
+
+	if len(e.Attachments) == 0 && e.Calendar == "" {
+		if e.HTML == "" {
+			message.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+			message.WriteString("\r\n")
+			message.WriteString(e.Body)
+			return message.Bytes(), nil
+		}
+		writer := multipart.NewWriter(&message)
+		fmt.Fprintf(&message, "Content-Type: multipart/alternative; boundary=%s\r\n", writer.Boundary())
+		message.WriteString("\r\n")
+		if err := writeBodies(writer, e.Body, e.HTML); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return message.Bytes(), nil
+	}
+
+	writer := multipart.NewWriter(&message)
+	fmt.Fprintf(&message, "Content-Type: multipart/mixed; boundary=%s\r\n", writer.Boundary())
+	message.WriteString("\r\n")
+
+	var err error
+	switch {
+	case e.Calendar != "":
+		err = writeInvite(writer, e.Body, e.HTML, e.Calendar)
+	case e.HTML != "":
+		err = writeAlternative(writer, func(alternativeWriter *multipart.Writer) error {
+			return writeBodies(alternativeWriter, e.Body, e.HTML)
+		})
+	default:
+		err = writeBodies(writer, e.Body, "")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range e.Attachments {
+		if err := writeAttachment(writer, path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return message.Bytes(), nil
+}
+
+// EstimatedSize returns the size of the message once encoded, counting the
+// base64 overhead (about 33%) of its attachments without reading them.
+func (e *Email) EstimatedSize() (int64, error) {
+	size := int64(len(e.To) + len(e.Cc) + len(e.Bcc) + len(e.Subject) + len(e.Body) + len(e.HTML))
+	// The invite is sent twice, base64 encoded
+	size += int64(len(e.Calendar)) * 8 / 3
+	for _, path := range e.Attachments {
+		info, err := os.Stat(path)
+		if err != nil {
+			return 0, fmt.Errorf("error reading attachment: %w", err)
+		}
+		// 4 encoded bytes per 3 input bytes, plus CRLF every 76 characters
+		encoded := (info.Size() + 2) / 3 * 4
+		size += encoded + encoded/76*2
+	}
+	return size, nil
+}
+
+// CheckSize returns an error wrapping ErrMessageTooLarge when the estimated
+// size of the message exceeds MaxMessageSize.
+func (e *Email) CheckSize() error {
+	size, err := e.EstimatedSize()
+	if err != nil {
+		return err
+	}
+	if size > MaxMessageSize {
+		return fmt.Errorf("%w: about %s encoded, Gmail's limit is %s; share large files as Google Drive links instead",
+			ErrMessageTooLarge, FormatSize(size), FormatSize(MaxMessageSize))
+	}
+	return nil
+}
+
+// writeAttachment adds the file at path to writer as a base64 attachment part.
+func writeAttachment(writer *multipart.Writer, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading attachment: %w", err)
+	}
+
+	name := filepath.Base(path)
+	mimeType, _, err := mime.ParseMediaType(mime.TypeByExtension(filepath.Ext(name)))
+	if err != nil {
+		mimeType = "application/octet-stream"
+	}
+
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {mime.FormatMediaType(mimeType, map[string]string{"name": name})},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": name})},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return err
+	}
+
+	return writeBase64(part, data)
+}
+
+// writeInvite adds a multipart/alternative part holding body, htmlBody when
+// set, and the calendar as text/calendar, which mail clients show as an invite with
+// accept and decline buttons, followed by the calendar as an invite.ics
+// attachment for the clients that only import files. The method (REQUEST,
+// CANCEL, ...) is taken from the calendar.
+func writeInvite(writer *multipart.Writer, body, htmlBody, calendar string) error {
+	method := calendarMethod(calendar)
+
+	err := writeAlternative(writer, func(alternativeWriter *multipart.Writer) error {
+		if err := writeBodies(alternativeWriter, body, htmlBody); err != nil {
+			return err
+		}
+		part, err := alternativeWriter.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {mime.FormatMediaType("text/calendar", map[string]string{"method": method, "charset": "UTF-8"})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return err
+		}
+		return writeBase64(part, []byte(calendar))
+	})
+	if err != nil {
+		return err
+	}
+
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {mime.FormatMediaType("application/ics", map[string]string{"name": "invite.ics"})},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": "invite.ics"})},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return err
+	}
+	return writeBase64(part, []byte(calendar))
+}
+
+// writeBodies adds body as a text/plain part to writer, followed by htmlBody
+// as a text/html part when it is set.
+func writeBodies(writer *multipart.Writer, body, htmlBody string) error {
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=UTF-8"},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := part.Write([]byte(body)); err != nil {
+		return err
+	}
+	if htmlBody == "" {
+		return nil
+	}
+	part, err = writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/html; charset=UTF-8"},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = part.Write([]byte(htmlBody))
+	return err
+}
+
+// writeAlternative adds a multipart/alternative part to writer holding the
+// parts written by fill.
+func writeAlternative(writer *multipart.Writer, fill func(*multipart.Writer) error) error {
+	var alternative bytes.Buffer
+	alternativeWriter := multipart.NewWriter(&alternative)
+	if err := fill(alternativeWriter); err != nil {
+		return err
+	}
+	if err := alternativeWriter.Close(); err != nil {
+		return err
+	}
+
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": alternativeWriter.Boundary()})},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = part.Write(alternative.Bytes())
+	return err
+}
+
+// calendarMethod returns the METHOD property of iCalendar data, REQUEST when
+// it has none.
+func calendarMethod(calendar string) string {
+	for _, line := range strings.Split(calendar, "\n") {
+		if name, value, ok := strings.Cut(strings.TrimSpace(line), ":"); ok && strings.EqualFold(name, "METHOD") && value != "" {
+			return strings.ToUpper(value)
+		}
+	}
+	return "REQUEST"
+}
+
+// writeBase64 writes data base64 encoded, wrapped at 76 characters per
+// RFC 2045.
+func writeBase64(w io.Writer, data []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		if _, err := fmt.Fprintf(w, "%s\r\n", encoded[:76]); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err := fmt.Fprintf(w, "%s\r\n", encoded)
+	return err
+}
+
+// DownloadAttachment downloads rawURL into dir so it can be attached like a
+// local file, and returns the path of the file. The name comes from the
+// Content-Disposition header or the URL path, with an extension matching the
+// Content-Type added when it has none. Downloads larger than MaxMessageSize
+// are abandoned, since Gmail would reject the message anyway.
+func DownloadAttachment(rawURL, dir string) (string, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return "", fmt.Errorf("invalid attachment URL %q: must be http or https", rawURL)
+	}
+
+	client := &http.Client{Timeout: AttachURLTimeout}
+	response, err := client.Get(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("error downloading %s: %w", rawURL, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error downloading %s: %s", rawURL, response.Status)
+	}
+	if response.ContentLength > MaxMessageSize {
+		return "", fmt.Errorf("%w: %s is %s, Gmail's limit is %s",
+			ErrMessageTooLarge, rawURL, FormatSize(response.ContentLength), FormatSize(MaxMessageSize))
+	}
+
+	name := path.Base(parsed.Path)
+	if _, params, err := mime.ParseMediaType(response.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		name = params["filename"]
+	}
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == "/" || name == ".." {
+		name = "attachment"
+	}
+	if filepath.Ext(name) == "" {
+		mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+		if exts, err := mime.ExtensionsByType(mediaType); err == nil && len(exts) > 0 {
+			name += exts[0]
+		}
+	}
+
+	// Each download gets its own directory so equal names do not collide
+	fileDir, err := os.MkdirTemp(dir, "url-")
+	if err != nil {
+		return "", fmt.Errorf("error creating download directory: %w", err)
+	}
+	filePath := filepath.Join(fileDir, name)
+	file, err := os.Create(filePath)
+	if err != nil {
+		return "", fmt.Errorf("error creating file: %w", err)
+	}
+	defer file.Close()
+
+	written, err := io.Copy(file, io.LimitReader(response.Body, MaxMessageSize+1))
+	if err != nil {
+		return "", fmt.Errorf("error downloading %s: %w", rawURL, err)
+	}
+	if written > MaxMessageSize {
+		return "", fmt.Errorf("%w: %s is larger than Gmail's limit of %s",
+			ErrMessageTooLarge, rawURL, FormatSize(MaxMessageSize))
+	}
+	return filePath, nil
+}
+
+// AppendSignature appends signature to body after the standard "-- "
+// signature delimiter line. An empty signature leaves body unchanged.
+func AppendSignature(body, signature string) string {
+	signature = strings.TrimRight(signature, "\r\n")
+	if signature == "" {
+		return body
+	}
+	if body != "" && !strings.HasSuffix(body, "\n") {
+		body += "\n"
+	}
+	return body + "-- \n" + signature + "\n"
+}
+
+// WrapText word-wraps the lines of a plain text body longer than width
+// characters; width 0 leaves it unchanged. Words are never split, so a URL
+// longer than width gets a line of its own. Pre-formatted lines are left as
+// they are: indented ones, quotes (>), the "-- " signature delimiter and
+// those within ``` fences.
+func WrapText(text string, width int) string {
+	if width <= 0 {
+		return text
+	}
+	lines := strings.Split(text, "\n")
+	wrapped := make([]string, 0, len(lines))
+	fenced := false
+	for _, line := range lines {
+		content, cr := strings.CutSuffix(line, "\r")
+		if strings.HasPrefix(content, "```") {
+			fenced = !fenced
+		}
+		if fenced || strings.HasPrefix(content, "```") || utf8.RuneCountInString(content) <= width ||
+			strings.HasPrefix(content, " ") || strings.HasPrefix(content, "\t") || strings.HasPrefix(content, ">") || content == "-- " {
+			wrapped = append(wrapped, line)
+			continue
+		}
+		ending := ""
+		if cr {
+			ending = "\r"
+		}
+		current, currentWidth := "", 0
+		for _, word := range strings.Fields(content) {
+			wordWidth := utf8.RuneCountInString(word)
+			if current != "" && currentWidth+1+wordWidth > width {
+				wrapped = append(wrapped, current+ending)
+				current, currentWidth = "", 0
+			}
+			if current != "" {
+				current += " "
+				currentWidth++
+			}
+			current += word
+			currentWidth += wordWidth
+		}
+		wrapped = append(wrapped, current+ending)
+	}
+	return strings.Join(wrapped, "\n")
+}
+
+// EncodeRaw returns the base64url encoding of a raw message, as expected by
+// the Raw field of a Gmail message.
+func EncodeRaw(raw []byte) string {
+	return base64.URLEncoding.EncodeToString(raw)
+}
+
+// DecodeRaw decodes the Raw field of a message fetched in raw format into its
+// RFC 822 source.
+func DecodeRaw(raw string) ([]byte, error) {
+	data, err := DecodeData(raw)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding raw message: %w", err)
+	}
+	return data, nil
+}
+
+// RawSubject returns the decoded Subject header of an RFC 822 message, or ""
+// when it cannot be parsed.
+func RawSubject(raw []byte) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return ""
+	}
+	subject := msg.Header.Get("Subject")
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(subject); err == nil {
+		return decoded
+	}
+	return subject
+}
+
+// SendEmail sends an email and returns the sent message. Messages over
+// MaxMessageSize are rejected before anything is uploaded.
+func SendEmail(service *gmail.Service, e *Email) (*gmail.Message, error) {
+	if err := e.CheckSize(); err != nil {
+		return nil, err
+	}
+
+	raw, err := e.Raw()
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &gmail.Message{
+		Raw:      EncodeRaw(raw),
+		ThreadId: e.ThreadID,
+	}
+
+	sent, err := service.Users.Messages.Send(UserID, msg).Do()
+	if err != nil {
+		return nil, fmt.Errorf("error sending email: %w", err)
+	}
+
+	return sent, nil
+}
+
+// CreateDraft saves an email as a draft and returns it. Messages over
+// MaxMessageSize are rejected before anything is uploaded.
+func CreateDraft(service *gmail.Service, e *Email) (*gmail.Draft, error) {
+	if err := e.CheckSize(); err != nil {
+		return nil, err
+	}
+
+	raw, err := e.Raw()
+	if err != nil {
+		return nil, err
+	}
+
+	draft := &gmail.Draft{
+		Message: &gmail.Message{
+			Raw:      EncodeRaw(raw),
+			ThreadId: e.ThreadID,
+		},
+	}
+
+	created, err := service.Users.Drafts.Create(UserID, draft).Do()
+	if err != nil {
+		return nil, fmt.Errorf("error creating draft: %w", err)
+	}
+
+	return created, nil
+}
+
+// ImportMessage validates raw as an RFC 822 message and imports it into the
+// mailbox with the given labels, as if it had been received. The Date header
+// is used as the message date.
+func ImportMessage(service *gmail.Service, raw []byte, labelIDs []string) (*gmail.Message, error) {
+	if _, err := mail.ReadMessage(bytes.NewReader(raw)); err != nil {
+		return nil, fmt.Errorf("invalid RFC 822 message: %w", err)
+	}
+
+	msg := &gmail.Message{
+		Raw:      EncodeRaw(raw),
+		LabelIds: labelIDs,
+	}
+
+	imported, err := service.Users.Messages.Import(UserID, msg).InternalDateSource("dateHeader").Do()
+	if err != nil {
+		return nil, fmt.Errorf("error importing message: %w", err)
+	}
+
+	return imported, nil
+}
+
+// InsertMessage validates raw as an RFC 822 message and inserts it into the
+// mailbox with the given labels. Unlike ImportMessage it skips Gmail's
+// spam classification and threading, storing the message as is, which
+// suits seeding test mailboxes. The Date header is used as the message date.
+func InsertMessage(service *gmail.Service, raw []byte, labelIDs []string) (*gmail.Message, error) {
+	if _, err := mail.ReadMessage(bytes.NewReader(raw)); err != nil {
+		return nil, fmt.Errorf("invalid RFC 822 message: %w", err)
+	}
+
+	msg := &gmail.Message{
+		Raw:      EncodeRaw(raw),
+		LabelIds: labelIDs,
+	}
+
+	inserted, err := service.Users.Messages.Insert(UserID, msg).InternalDateSource("dateHeader").Do()
+	if err != nil {
+		return nil, fmt.Errorf("error inserting message: %w", err)
+	}
+
+	return inserted, nil
+}
+
+// PrepareResend turns raw, the source of a sent message, into a new message
+// with the same content: the Date and Message-ID headers are dropped so Gmail
+// sets fresh ones when it is sent. A non-empty to replaces the To header and
+// drops the Cc and Bcc recipients.
+func PrepareResend(raw []byte, to string) ([]byte, error) {
+	if _, err := mail.ReadMessage(bytes.NewReader(raw)); err != nil {
+		return nil, fmt.Errorf("invalid RFC 822 message: %w", err)
+	}
+
+	// end is just past the line ending of the last header
+	end := len(raw)
+	if i := bytes.Index(raw, []byte("\r\n\r\n")); i >= 0 {
+		end = i + 2
+	} else if i := bytes.Index(raw, []byte("\n\n")); i >= 0 {
+		end = i + 1
+	}
+
+	drop := []string{"Date", "Message-Id"}
+	var message bytes.Buffer
+	if to != "" {
+		fmt.Fprintf(&message, "To: %s\r\n", to)
+		drop = append(drop, "To", "Cc", "Bcc")
+	}
+
+	// Folded lines belong to the header above them
+	skip := false
+	for _, line := range bytes.SplitAfter(raw[:end], []byte("\n")) {
+		if len(line) > 0 && line[0] != ' ' && line[0] != '\t' {
+			name, _, _ := bytes.Cut(line, []byte(":"))
+			skip = slices.Contains(drop, textproto.CanonicalMIMEHeaderKey(string(bytes.TrimSpace(name))))
+		}
+		if !skip {
+			message.Write(line)
+		}
+	}
+	message.Write(raw[end:])
+	return message.Bytes(), nil
+}
+
+// SendRaw sends an RFC 822 message as is and returns the sent message.
+func SendRaw(service *gmail.Service, raw []byte) (*gmail.Message, error) {
+	sent, err := service.Users.Messages.Send(UserID, &gmail.Message{Raw: EncodeRaw(raw)}).Do()
+	if err != nil {
+		return nil, fmt.Errorf("error sending email: %w", err)
+	}
+	return sent, nil
+}
+
+// NewReply builds a reply to original, quoting its text body under body. The
+// reply goes to the Reply-To or From address; with all set, the original To
+// and Cc recipients are copied too, except self. Threading headers keep the
+// reply in the original conversation.
+func NewReply(original *gmail.Message, body, self string, all bool) *Email {
+	headers := MessageHeaders(original)
+	from := headerValue(headers, "From")
+	sender := headerValue(headers, "Reply-To")
+	if sender == "" {
+		sender = from
+	}
+
+	var to []*mail.Address
+	if isAddress(sender, self) {
+		// Replying to our own message goes to its recipients
+		to = parseAddresses(headerValue(headers, "To"))
+	} else {
+		to = parseAddresses(sender)
+	}
+
+	seen := map[string]bool{strings.ToLower(self): true}
+	to = dedupeAddresses(to, seen)
+
+	var cc []*mail.Address
+	if all {
+		cc = append(parseAddresses(headerValue(headers, "To")), parseAddresses(headerValue(headers, "Cc"))...)
+		cc = dedupeAddresses(cc, seen)
+	}
+
+	subject := headerValue(headers, "Subject")
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = "Re: " + subject
+	}
+
+	messageID := headerValue(headers, "Message-ID")
+	references := strings.TrimSpace(headerValue(headers, "References") + " " + messageID)
+
+	return &Email{
+		To:         formatAddresses(to),
+		Cc:         formatAddresses(cc),
+		Subject:    subject,
+		Body:       body + "\n\n" + quote(original, from),
+		InReplyTo:  messageID,
+		References: references,
+		ThreadID:   original.ThreadId,
+	}
+}
+
+// quote returns the text body of msg as a quoted block with an attribution line.
+func quote(msg *gmail.Message, from string) string {
+	var quoted strings.Builder
+	if date := headerValue(MessageHeaders(msg), "Date"); date != "" {
+		fmt.Fprintf(&quoted, "On %s, ", date)
+	}
+	fmt.Fprintf(&quoted, "%s wrote:\n", from)
+	for _, line := range strings.Split(strings.TrimRight(GetBody(msg.Payload), "\r\n"), "\n") {
+		quoted.WriteString("> " + strings.TrimRight(line, "\r") + "\n")
+	}
+	return quoted.String()
+}
+
+// parseAddresses parses an address list header, skipping it when malformed.
+func parseAddresses(list string) []*mail.Address {
+	if strings.TrimSpace(list) == "" {
+		return nil
+	}
+	addresses, err := mail.ParseAddressList(list)
+	if err != nil {
+		return nil
+	}
+	return addresses
+}
+
+// isAddress reports whether the address header value refers to address.
+func isAddress(value, address string) bool {
+	parsed, err := mail.ParseAddress(value)
+	return err == nil && strings.EqualFold(parsed.Address, address)
+}
+
+// dedupeAddresses drops addresses already present in seen (keyed by
+// lowercase address) and records the remaining ones.
+func dedupeAddresses(addresses []*mail.Address, seen map[string]bool) []*mail.Address {
+	var kept []*mail.Address
+	for _, address := range addresses {
+		key := strings.ToLower(address.Address)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		kept = append(kept, address)
+	}
+	return kept
+}
+
+// formatAddresses joins addresses into an address list header value.
+func formatAddresses(addresses []*mail.Address) string {
+	formatted := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		formatted = append(formatted, address.String())
+	}
+	return strings.Join(formatted, ", ")
+}
@@ -0,0 +1,135 @@
+package gmail
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sentMessage builds e as SendEmail would and parses the result back.
+func sentMessage(t *testing.T, e *Email) *mail.Message {
+	t.Helper()
+	raw, err := e.Raw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeRaw(EncodeRaw(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(decoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestRawBcc(t *testing.T) {
+	msg := sentMessage(t, &Email{
+		To:      "alice@example.com",
+		Cc:      "bob@example.com",
+		Bcc:     "carol@example.com, dave@example.com",
+		Subject: "Hello",
+		Body:    "Hi",
+	})
+
+	// Gmail takes the Bcc recipients from this header and removes it from
+	// the delivered copies
+	if got := msg.Header.Get("Bcc"); got != "carol@example.com, dave@example.com" {
+		t.Errorf("Bcc header = %q, want the Bcc recipients", got)
+	}
+
+	// The Bcc addresses must not leak into any other header or the body
+	for _, name := range []string{"To", "Cc", "Reply-To", "Subject"} {
+		if value := msg.Header.Get(name); strings.Contains(value, "carol@") || strings.Contains(value, "dave@") {
+			t.Errorf("%s header %q contains a Bcc address", name, value)
+		}
+	}
+	body, _ := io.ReadAll(msg.Body)
+	if strings.Contains(string(body), "carol@") {
+		t.Errorf("body contains a Bcc address: %q", body)
+	}
+}
+
+func TestRawWithoutBcc(t *testing.T) {
+	msg := sentMessage(t, &Email{To: "alice@example.com", Subject: "Hello", Body: "Hi"})
+	if _, ok := msg.Header["Bcc"]; ok {
+		t.Errorf("Bcc header present without Bcc recipients")
+	}
+}
+
+// contentTypes returns the media types of a MIME entity and of all its
+// nested parts.
+func contentTypes(t *testing.T, contentType string, body io.Reader) []string {
+	t.Helper()
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := []string{mediaType}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return types
+	}
+	reader := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return types
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, contentTypes(t, part.Header.Get("Content-Type"), part)...)
+	}
+}
+
+func TestRawHTML(t *testing.T) {
+	attachment := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(attachment, []byte("notes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	invite := "BEGIN:VCALENDAR\r\nMETHOD:REQUEST\r\nEND:VCALENDAR\r\n"
+	html := TextToHTML("Hi", "https://example.com/pixel.gif")
+
+	tests := []struct {
+		name  string
+		email *Email
+		want  []string
+	}{
+		{"plain", &Email{Body: "Hi"}, []string{"text/plain"}},
+		{"attachment", &Email{Body: "Hi", Attachments: []string{attachment}}, []string{"multipart/mixed", "text/plain", "text/plain"}},
+		{"html", &Email{Body: "Hi", HTML: html}, []string{"multipart/alternative", "text/plain", "text/html"}},
+		{"html attachment", &Email{Body: "Hi", HTML: html, Attachments: []string{attachment}},
+			[]string{"multipart/mixed", "multipart/alternative", "text/plain", "text/html", "text/plain"}},
+		{"html invite", &Email{Body: "Hi", HTML: html, Calendar: invite},
+			[]string{"multipart/mixed", "multipart/alternative", "text/plain", "text/html", "text/calendar", "application/ics"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.email.To, tt.email.Subject = "alice@example.com", "Hello"
+			msg := sentMessage(t, tt.email)
+			types := contentTypes(t, msg.Header.Get("Content-Type"), msg.Body)
+			if strings.Join(types, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("parts = %v, want %v", types, tt.want)
+			}
+		})
+	}
+}
+
+func TestTextToHTML(t *testing.T) {
+	got := TextToHTML("a < b\nc", "https://example.com/p.gif?id=1&x=2")
+	for _, want := range []string{"a &lt; b\nc", `<img src="https://example.com/p.gif?id=1&amp;x=2" width="1" height="1" alt="">`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("TextToHTML = %q, lacks %q", got, want)
+		}
+	}
+	if strings.Contains(TextToHTML("Hi", ""), "<img") {
+		t.Errorf("TextToHTML without a pixel URL has an image")
+	}
+}
@@ -0,0 +1,140 @@
+package gmail
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"email-manager/pkg/auth"
+)
+
+// QueryOptions are structured search criteria translated to Gmail search
+// operators by BuildQuery.
+type QueryOptions struct {
+	From          string
+	To            string
+	Subject       string
+	HasAttachment bool
+	IsUnread      bool
+	// LargerThan is a size such as "5M" or "100K".
+	LargerThan string
+	// NewerThan is a relative age such as "7d", "2m" or "1y".
+	NewerThan string
+	// OlderThan is a relative age such as "90d", "6m" or "1y".
+	OlderThan string
+}
+
+// BuildQuery appends the operators for opts to the raw query q and returns
+// the resulting Gmail search string.
+func BuildQuery(q string, opts QueryOptions) string {
+	terms := []string{}
+	if q = strings.TrimSpace(q); q != "" {
+		terms = append(terms, q)
+	}
+
+	add := func(operator, value string) {
+		if value = strings.TrimSpace(value); value != "" {
+			terms = append(terms, operator+":"+quoteTerm(value))
+		}
+	}
+	add("from", opts.From)
+	add("to", opts.To)
+	add("subject", opts.Subject)
+	if opts.HasAttachment {
+		terms = append(terms, "has:attachment")
+	}
+	if opts.IsUnread {
+		terms = append(terms, "is:unread")
+	}
+	add("larger", opts.LargerThan)
+	add("newer_than", opts.NewerThan)
+	add("older_than", opts.OlderThan)
+
+	return strings.Join(terms, " ")
+}
+
+// ValidAge reports whether age is a relative age accepted by the newer_than
+// and older_than operators: a number of days, months or years such as "90d".
+func ValidAge(age string) bool {
+	if len(age) < 2 || !strings.ContainsAny(age[len(age)-1:], "dmy") {
+		return false
+	}
+	return strings.Trim(age[:len(age)-1], "0123456789") == ""
+}
+
+// quoteTerm quotes a value containing spaces. Gmail has no escape for
+// double quotes inside a quoted term, so they are dropped.
+func quoteTerm(value string) string {
+	if !strings.ContainsAny(value, " \t") {
+		return value
+	}
+	return `"` + strings.ReplaceAll(value, `"`, "") + `"`
+}
+
+// SavedSearchesPath returns the file defining the saved searches, one
+// name = "query" per line.
+func SavedSearchesPath() string {
+	return filepath.Join(auth.ConfigDir(), "searches.conf")
+}
+
+// SavedSearch returns the query saved under name.
+func SavedSearch(name string) (string, error) {
+	searches, err := SavedSearches()
+	if err != nil {
+		return "", err
+	}
+	q, ok := searches[name]
+	if !ok {
+		return "", fmt.Errorf("no saved search %q in %s", name, SavedSearchesPath())
+	}
+	return q, nil
+}
+
+// SavedSearches returns the saved queries by name, or none when the file
+// does not exist.
+func SavedSearches() (map[string]string, error) {
+	data, err := os.ReadFile(SavedSearchesPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading saved searches: %w", err)
+	}
+	searches, err := parseSavedSearches(data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", SavedSearchesPath(), err)
+	}
+	return searches, nil
+}
+
+// parseSavedSearches parses name = query lines. Blank lines and lines
+// starting with # are skipped; a query may be double-quoted.
+func parseSavedSearches(data []byte) (map[string]string, error) {
+	searches := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, q, ok := strings.Cut(line, "=")
+		name, q = strings.TrimSpace(name), strings.TrimSpace(q)
+		if !ok || name == "" || q == "" {
+			return nil, fmt.Errorf("line %d: expected name = \"query\"", n)
+		}
+		if strings.HasPrefix(q, `"`) {
+			unquoted, err := strconv.Unquote(q)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid quoted query %s", n, q)
+			}
+			q = unquoted
+		}
+		searches[name] = q
+	}
+	return searches, scanner.Err()
+}
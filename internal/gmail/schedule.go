@@ -0,0 +1,62 @@
+package gmail
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"email-manager/pkg/auth"
+)
+
+// ScheduledSend is a draft queued by send --schedule, sent by send-scheduled
+// once SendAt has passed.
+type ScheduledSend struct {
+	DraftID string    `json:"draft_id"`
+	SendAt  time.Time `json:"send_at"`
+	To      string    `json:"to"`
+	Subject string    `json:"subject"`
+	// UserID is the mailbox the draft was created in.
+	UserID string `json:"user_id"`
+}
+
+// SchedulePath returns the file holding the queue of scheduled sends.
+func SchedulePath() string {
+	return filepath.Join(auth.DataDir(), "scheduled.json")
+}
+
+// LoadSchedule returns the queued sends, or none when nothing was scheduled.
+func LoadSchedule() ([]ScheduledSend, error) {
+	data, err := os.ReadFile(SchedulePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading schedule: %w", err)
+	}
+
+	var queue []ScheduledSend
+	if err := json.Unmarshal(data, &queue); err != nil {
+		return nil, fmt.Errorf("error parsing schedule %s: %w", SchedulePath(), err)
+	}
+	return queue, nil
+}
+
+// SaveSchedule replaces the queue of scheduled sends.
+func SaveSchedule(queue []ScheduledSend) error {
+	data, err := json.MarshalIndent(queue, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := SchedulePath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("error creating data directory: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("error writing schedule: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package gmail
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"email-manager/pkg/auth"
+)
+
+// SentTTL is how long sent messages are remembered to catch accidental
+// resends of the same message.
+const SentTTL = time.Hour
+
+// ErrDuplicateSend is returned by CheckDuplicate when the same message was
+// sent, or its send attempted, within SentTTL.
+var ErrDuplicateSend = errors.New("duplicate send")
+
+// sentRecord is a message recorded by RecordSend. MessageID is empty while
+// the send is in flight, and stays empty if it failed without an answer
+// from Gmail, which may have accepted the message anyway.
+type sentRecord struct {
+	Hash      string    `json:"hash"`
+	SentAt    time.Time `json:"sent_at"`
+	MessageID string    `json:"message_id,omitempty"`
+}
+
+// sentPath returns the file holding the recently sent message hashes.
+func sentPath() string {
+	return filepath.Join(auth.DataDir(), "sent.json")
+}
+
+// Hash identifies the content of e: its recipients, headers, body and the
+// content of its attachments, in the mailbox it is sent from. Raw cannot be
+// hashed directly since its MIME boundaries are random.
+func (e *Email) Hash() (string, error) {
+	h := sha256.New()
+	for _, field := range []string{UserID, e.To, e.Cc, e.Bcc, e.ReplyTo, e.Subject, e.Body, e.HTML,
+		e.InReplyTo, e.References, e.ThreadID, e.Priority, e.Calendar} {
+		fmt.Fprintf(h, "%d:%s\n", len(field), field)
+	}
+	for _, path := range e.Attachments {
+		file, err := os.Open(path)
+		if err != nil {
+			return "", fmt.Errorf("error reading attachment %s: %w", path, err)
+		}
+		_, err = io.Copy(h, file)
+		file.Close()
+		if err != nil {
+			return "", fmt.Errorf("error reading attachment %s: %w", path, err)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// CheckDuplicate returns ErrDuplicateSend when a message with the given hash
+// was recorded within SentTTL.
+func CheckDuplicate(hash string) error {
+	for _, record := range loadSent() {
+		if record.Hash != hash {
+			continue
+		}
+		if record.MessageID == "" {
+			return fmt.Errorf("%w: an identical message was attempted at %s and may have been sent; check your Sent folder",
+				ErrDuplicateSend, record.SentAt.Local().Format("15:04:05"))
+		}
+		return fmt.Errorf("%w: an identical message was sent at %s (message ID %s)",
+			ErrDuplicateSend, record.SentAt.Local().Format("15:04:05"), record.MessageID)
+	}
+	return nil
+}
+
+// RecordSend records a message hash with the ID Gmail returned for it, or
+// with no ID before the message is sent. Failing to write the record only
+// disables duplicate detection, so errors are ignored.
+func RecordSend(hash, messageID string) {
+	records := []sentRecord{{Hash: hash, SentAt: time.Now(), MessageID: messageID}}
+	for _, record := range loadSent() {
+		if record.Hash != hash {
+			records = append(records, record)
+		}
+	}
+	saveSent(records)
+}
+
+// ForgetSend removes a message hash, for sends Gmail definitely rejected.
+func ForgetSend(hash string) {
+	var records []sentRecord
+	for _, record := range loadSent() {
+		if record.Hash != hash {
+			records = append(records, record)
+		}
+	}
+	saveSent(records)
+}
+
+// loadSent returns the records younger than SentTTL.
+func loadSent() []sentRecord {
+	data, err := os.ReadFile(sentPath())
+	if err != nil {
+		return nil
+	}
+	var records []sentRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil
+	}
+
+	recent := records[:0]
+	for _, record := range records {
+		if time.Since(record.SentAt) < SentTTL {
+			recent = append(recent, record)
+		}
+	}
+	return recent
+}
+
+// saveSent replaces the sent records.
+func saveSent(records []sentRecord) {
+	data, err := json.Marshal(records)
+	if err != nil {
+		return
+	}
+	path := sentPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return
+	}
+	_ = os.WriteFile(path, data, 0600)
+}
@@ -2,11 +2,22 @@
 package gmail
 
 import (
+	"cmp"
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"html"
+	"mime"
+	"net/mail"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"text/template"
+	"time"
+	"unicode"
 
 	"email-manager/pkg/auth"
 
@@ -14,17 +25,26 @@ import (
 	"google.golang.org/api/option"
 )
 
+// UserID is the mailbox every API call acts on: "me" for the authenticated
+// user, or the address of a delegated or shared mailbox.
+var UserID = "me"
+
 // GetService returns a Gmail service instance.
 func GetService(ctx context.Context) (*gmail.Service, error) {
 	client, err := auth.GetClient(ctx)
 	if err != nil {
 		return nil, err
 	}
+	client.Transport = &acceptTransport{base: client.Transport}
+	if stats != nil {
+		client.Transport = &loggingTransport{base: client.Transport}
+	}
 
 	service, err := gmail.NewService(ctx, option.WithHTTPClient(client))
 	if err != nil {
 		return nil, fmt.Errorf("unable to create Gmail service: %w", err)
 	}
+	apiClient = client
 
 	return service, nil
 }
@@ -42,10 +62,54 @@ func ExtractHeaders(headers []*gmail.MessagePartHeader) (subject, from string) {
 	return
 }
 
+// MessageHeaders returns the headers of msg, or none when it has no payload,
+// as with the minimal and raw formats.
+func MessageHeaders(msg *gmail.Message) []*gmail.MessagePartHeader {
+	if msg.Payload == nil {
+		return nil
+	}
+	return msg.Payload.Headers
+}
+
+// dataEncodings are the base64 variants tried by DecodeData, the one Gmail
+// documents first.
+var dataEncodings = []struct {
+	name     string
+	encoding *base64.Encoding
+}{
+	{"base64url", base64.URLEncoding},
+	{"unpadded base64url", base64.RawURLEncoding},
+	{"base64", base64.StdEncoding},
+	{"unpadded base64", base64.RawStdEncoding},
+}
+
+// DecodeData decodes message or attachment data. Gmail documents base64url
+// but occasionally returns standard or unpadded base64, so each variant is
+// tried in turn; a fallback is reported under --verbose.
+func DecodeData(data string) ([]byte, error) {
+	var firstErr error
+	for i, variant := range dataEncodings {
+		decoded, err := variant.encoding.DecodeString(data)
+		if err == nil {
+			if i > 0 && stats != nil {
+				fmt.Fprintf(os.Stderr, "Decoded data as %s\n", variant.name)
+			}
+			return decoded, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
 // GetBody extracts the body text from a message part.
 func GetBody(part *gmail.MessagePart) string {
+	if part == nil {
+		return "[No content available]"
+	}
 	if part.Body != nil && part.Body.Data != "" {
-		data, err := base64.URLEncoding.DecodeString(part.Body.Data)
+		data, err := DecodeData(part.Body.Data)
 		if err == nil {
 			return string(data)
 		}
@@ -54,7 +118,7 @@ func GetBody(part *gmail.MessagePart) string {
 	for _, p := range part.Parts {
 		if p.MimeType == "text/plain" {
 			if p.Body != nil && p.Body.Data != "" {
-				data, err := base64.URLEncoding.DecodeString(p.Body.Data)
+				data, err := DecodeData(p.Body.Data)
 				if err == nil {
 					return string(data)
 				}
@@ -65,63 +129,768 @@ func GetBody(part *gmail.MessagePart) string {
 	return "[No text content]"
 }
 
+// errFound stops a part walk once the wanted part has been found.
+var errFound = errors.New("found")
+
+// GetHTMLBody extracts the first text/html body from a message part.
+// It returns an empty string when the message has no HTML content.
+func GetHTMLBody(part *gmail.MessagePart) string {
+	var html string
+	walkParts(part, func(p *gmail.MessagePart) error {
+		if p.MimeType != "text/html" || p.Body == nil || p.Body.Data == "" {
+			return nil
+		}
+		data, err := DecodeData(p.Body.Data)
+		if err != nil {
+			return nil
+		}
+		html = string(data)
+		return errFound
+	})
+	return html
+}
+
+// SaveInlineImages writes the inline image parts referenced through cid: URLs
+// in html to dir, and returns html with those references rewritten to the
+// local filenames along with the number of images saved.
+func SaveInlineImages(service *gmail.Service, messageID string, payload *gmail.MessagePart, html, dir string) (string, int, error) {
+	count := 0
+	err := walkParts(payload, func(p *gmail.MessagePart) error {
+		contentID := strings.Trim(headerValue(p.Headers, "Content-ID"), "<> ")
+		if contentID == "" || p.Body == nil || !strings.Contains(html, "cid:"+contentID) {
+			return nil
+		}
+
+		data, err := partData(service, messageID, p)
+		if err != nil {
+			return fmt.Errorf("error getting inline image %s: %w", contentID, err)
+		}
+
+		name := inlineImageName(p, contentID)
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			return fmt.Errorf("error writing file %s: %w", path, err)
+		}
+
+		html = strings.ReplaceAll(html, "cid:"+contentID, name)
+		count++
+		return nil
+	})
+	return html, count, err
+}
+
+// partData returns the decoded content of a part, downloading it when the
+// body is stored as a separate attachment.
+func partData(service *gmail.Service, messageID string, part *gmail.MessagePart) ([]byte, error) {
+	encoded := part.Body.Data
+	if part.Body.AttachmentId != "" {
+		attachment, err := service.Users.Messages.Attachments.Get(UserID, messageID, part.Body.AttachmentId).Do()
+		if err != nil {
+			return nil, err
+		}
+		encoded = attachment.Data
+	}
+	return DecodeData(encoded)
+}
+
+// inlineImageName picks a safe local filename for an inline part, falling
+// back to the Content-ID and an extension derived from the MIME type.
+func inlineImageName(part *gmail.MessagePart, contentID string) string {
+	if part.Filename != "" {
+		return "inline_" + filepath.Base(part.Filename)
+	}
+	name := strings.NewReplacer("/", "_", "\\", "_", "@", "_").Replace(contentID)
+	if exts, err := mime.ExtensionsByType(part.MimeType); err == nil && len(exts) > 0 {
+		name += exts[0]
+	}
+	return "inline_" + name
+}
+
+// headerValue returns the value of the named header, or an empty string.
+func headerValue(headers []*gmail.MessagePartHeader, name string) string {
+	for _, header := range headers {
+		if strings.EqualFold(header.Name, name) {
+			return header.Value
+		}
+	}
+	return ""
+}
+
+// AuthResults summarizes the SPF, DKIM and DMARC verdicts of a message, e.g.
+// "SPF: pass, DKIM: pass, DMARC: pass". They come from the first
+// Authentication-Results header, the one Gmail adds on receipt; a missing SPF
+// verdict falls back to Received-SPF, and a missing DKIM verdict to the
+// presence of a DKIM-Signature. Verdicts not found are reported as none.
+func AuthResults(headers []*gmail.MessagePartHeader) string {
+	verdicts := map[string]string{}
+	if results := headerValue(headers, "Authentication-Results"); results != "" {
+		// The first clause is the ID of the server that checked the message
+		clauses := strings.Split(stripComments(results), ";")
+		for _, clause := range clauses[1:] {
+			method, result, ok := strings.Cut(clause, "=")
+			fields := strings.Fields(result)
+			if !ok || len(fields) == 0 {
+				continue
+			}
+			method = strings.ToLower(strings.TrimSpace(method))
+			if _, seen := verdicts[method]; !seen {
+				verdicts[method] = strings.ToLower(fields[0])
+			}
+		}
+	}
+	if verdicts["spf"] == "" {
+		if fields := strings.Fields(headerValue(headers, "Received-SPF")); len(fields) > 0 {
+			verdicts["spf"] = strings.ToLower(fields[0])
+		}
+	}
+	if verdicts["dkim"] == "" && headerValue(headers, "DKIM-Signature") != "" {
+		verdicts["dkim"] = "signed (unverified)"
+	}
+
+	var summary []string
+	for _, method := range []string{"spf", "dkim", "dmarc"} {
+		verdict := verdicts[method]
+		if verdict == "" {
+			verdict = "none"
+		}
+		summary = append(summary, strings.ToUpper(method)+": "+verdict)
+	}
+	return strings.Join(summary, ", ")
+}
+
+// stripComments removes the parenthesized comments of a header value, which
+// may contain semicolons and equal signs.
+func stripComments(value string) string {
+	var b strings.Builder
+	depth := 0
+	for _, r := range value {
+		switch {
+		case r == '(':
+			depth++
+		case r == ')' && depth > 0:
+			depth--
+		case depth == 0:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// ListOptions controls how ListMessagesWithDetails prints messages.
+type ListOptions struct {
+	// SnippetWidth truncates the body preview to this many characters; 0 hides it.
+	SnippetWidth int
+	// Full fetches complete messages instead of only the listed headers.
+	Full bool
+	// UTC prints dates in UTC instead of the local timezone.
+	UTC bool
+	// Sort orders the fetched messages by "date" (oldest first), "-date"
+	// (newest first) or "subject"; empty keeps the API order.
+	Sort string
+	// Progress shows a "Fetching n/total..." line on stderr while the
+	// message details are retrieved.
+	Progress bool
+	// Template, when set, replaces the default output: it is executed with
+	// each message's MessageView and followed by a newline.
+	Template *template.Template
+	// Dedupe shows only the most recent of the fetched messages of each
+	// thread.
+	Dedupe bool
+	// Attachments fetches full messages, keeps those with FileAttachments
+	// and shows their filenames.
+	Attachments bool
+}
+
+// listHeaders are the headers fetched for listings in metadata format.
+var listHeaders = []string{"From", "To", "Cc", "Subject", "Date"}
+
+// MessageView holds the fields of a message available to output templates,
+// e.g. {{.Received}} {{.From}} - {{.Subject}}, and to JSON output.
+type MessageView struct {
+	ID       string `json:"id"`
+	ThreadID string `json:"thread_id"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Cc       string `json:"cc"`
+	Subject  string `json:"subject"`
+	// Date is the Date header as sent; Received is Gmail's internal date.
+	Date     string   `json:"date"`
+	Received string   `json:"received"`
+	Snippet  string   `json:"snippet"`
+	LabelIDs []string `json:"label_ids"`
+	// Labels are the display names of LabelIDs, e.g. Inbox or Promotions.
+	Labels []string `json:"labels"`
+	// Body is the plain text body, empty for listings without --full.
+	Body string `json:"body"`
+}
+
+// NewMessageView extracts the template fields of msg, formatting Received
+// in the local timezone or in UTC and resolving label names.
+func NewMessageView(service *gmail.Service, msg *gmail.Message, utc bool) MessageView {
+	view := MessageView{
+		ID:       msg.Id,
+		ThreadID: msg.ThreadId,
+		Received: FormatInternalDate(msg.InternalDate, utc),
+		Snippet:  html.UnescapeString(msg.Snippet),
+		LabelIDs: msg.LabelIds,
+		Labels:   LabelNames(service, msg.LabelIds),
+	}
+	if msg.Payload != nil {
+		headers := msg.Payload.Headers
+		view.From = headerValue(headers, "From")
+		view.To = headerValue(headers, "To")
+		view.Cc = headerValue(headers, "Cc")
+		view.Subject = headerValue(headers, "Subject")
+		view.Date = headerValue(headers, "Date")
+		view.Body = GetBody(msg.Payload)
+	}
+	return view
+}
+
+// FetchMessages gets the messages with the given IDs in the given format
+// ("full", "metadata", ...), running up to concurrency requests at once, and
+// calls fn with each message (or the error getting it) in the order of ids.
+// It stops at the first error fn returns.
+func FetchMessages(service *gmail.Service, ids []string, format string, concurrency int, fn func(id string, msg *gmail.Message, err error) error) error {
+	type result struct {
+		msg *gmail.Message
+		err error
+	}
+	results := make([]chan result, len(ids))
+	for i := range results {
+		results[i] = make(chan result, 1)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		sem := make(chan struct{}, max(concurrency, 1))
+		for i, id := range ids {
+			select {
+			case sem <- struct{}{}:
+			case <-done:
+				return
+			}
+			go func() {
+				defer func() { <-sem }()
+				msg, err := service.Users.Messages.Get(UserID, id).Format(format).Do()
+				results[i] <- result{msg, err}
+			}()
+		}
+	}()
+
+	for i, id := range ids {
+		r := <-results[i]
+		if err := fn(id, r.msg, r.err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // ListMessagesWithDetails prints detailed information about messages.
-func ListMessagesWithDetails(service *gmail.Service, messages []*gmail.Message) error {
-	for _, msg := range messages {
-		fullMsg, err := service.Users.Messages.Get("me", msg.Id).Do()
+func ListMessagesWithDetails(service *gmail.Service, messages []*gmail.Message, opts ListOptions) error {
+	details := make([]*gmail.Message, 0, len(messages))
+	for i, msg := range messages {
+		if opts.Progress {
+			fmt.Fprintf(os.Stderr, "\rFetching %d/%d...", i+1, len(messages))
+		}
+		call := service.Users.Messages.Get(UserID, msg.Id)
+		if !opts.Full && !opts.Attachments {
+			call = call.Format("metadata").MetadataHeaders(listHeaders...)
+		}
+		fullMsg, err := call.Do()
 		if err != nil {
+			if opts.Progress {
+				clearLine()
+			}
 			fmt.Fprintf(os.Stderr, "Warning: failed to get message %s: %v\n", msg.Id, err)
 			continue
 		}
+		if opts.Attachments && len(FileAttachments(fullMsg.Payload)) == 0 {
+			continue
+		}
+		details = append(details, fullMsg)
+	}
+	if opts.Progress {
+		clearLine()
+	}
+	if opts.Attachments && len(details) == 0 {
+		fmt.Fprintf(os.Stderr, "No messages with attachments found.\n")
+		return nil
+	}
+
+	sortMessages(details, opts.Sort)
+
+	var hidden map[string]int
+	if opts.Dedupe {
+		details, hidden = dedupeThreads(details)
+	}
+
+	if opts.Template != nil {
+		for _, msg := range details {
+			if err := opts.Template.Execute(os.Stdout, NewMessageView(service, msg, opts.UTC)); err != nil {
+				return fmt.Errorf("error executing template: %w", err)
+			}
+			fmt.Println()
+		}
+		return nil
+	}
 
-		subject, from := ExtractHeaders(fullMsg.Payload.Headers)
+	for _, msg := range details {
+		subject, from := ExtractHeaders(MessageHeaders(msg))
 		fmt.Printf("ID: %s\n", msg.Id)
 		fmt.Printf("From: %s\n", from)
-		fmt.Printf("Subject: %s\n", subject)
+		if n := hidden[msg.ThreadId]; n > 0 {
+			fmt.Printf("Subject: %s (%d more in thread)\n", subject, n)
+		} else {
+			fmt.Printf("Subject: %s\n", subject)
+		}
+		fmt.Printf("Date: %s\n", FormatInternalDate(msg.InternalDate, opts.UTC))
+		if len(msg.LabelIds) > 0 {
+			fmt.Printf("Labels: %s\n", strings.Join(LabelNames(service, msg.LabelIds), ", "))
+		}
+		if opts.SnippetWidth > 0 && msg.Snippet != "" {
+			fmt.Printf("Snippet: %s\n", Truncate(SanitizeText(html.UnescapeString(msg.Snippet)), opts.SnippetWidth))
+		}
+		if opts.Attachments {
+			var names []string
+			for _, attachment := range FileAttachments(msg.Payload) {
+				names = append(names, fmt.Sprintf("%s (%s)", SanitizeText(attachment.Filename), FormatSize(attachment.Size)))
+			}
+			fmt.Printf("Attachments: %s\n", strings.Join(names, ", "))
+		}
 		fmt.Println("---")
 	}
 	return nil
 }
 
-// ProcessAttachments recursively processes and downloads attachments.
-func ProcessAttachments(service *gmail.Service, messageID string, part *gmail.MessagePart, dir string, count *int) error {
-	// Check if this part has a filename (is an attachment)
-	if part.Filename != "" && part.Body != nil {
-		attachmentID := part.Body.AttachmentId
+// dedupeThreads keeps the most recent message of each thread, at the position
+// of the first message of the thread, and returns the number of messages
+// dropped per thread ID.
+func dedupeThreads(messages []*gmail.Message) ([]*gmail.Message, map[string]int) {
+	latest := make(map[string]*gmail.Message)
+	hidden := make(map[string]int)
+	for _, msg := range messages {
+		if kept, ok := latest[msg.ThreadId]; ok {
+			hidden[msg.ThreadId]++
+			if msg.InternalDate <= kept.InternalDate {
+				continue
+			}
+		}
+		latest[msg.ThreadId] = msg
+	}
 
-		if attachmentID != "" {
-			// Download the attachment
-			fmt.Fprintf(os.Stderr, "Downloading: %s\n", part.Filename)
+	deduped := make([]*gmail.Message, 0, len(latest))
+	for _, msg := range messages {
+		if kept, ok := latest[msg.ThreadId]; ok {
+			deduped = append(deduped, kept)
+			delete(latest, msg.ThreadId)
+		}
+	}
+	return deduped, hidden
+}
 
-			attachment, err := service.Users.Messages.Attachments.Get("me", messageID, attachmentID).Do()
-			if err != nil {
-				return fmt.Errorf("error downloading attachment %s: %w", part.Filename, err)
-			}
+// clearLine erases the progress line on stderr.
+func clearLine() {
+	fmt.Fprint(os.Stderr, "\r\033[K")
+}
+
+// sortMessages sorts messages in place by a ListOptions.Sort key.
+func sortMessages(messages []*gmail.Message, key string) {
+	switch key {
+	case "date":
+		slices.SortStableFunc(messages, func(a, b *gmail.Message) int {
+			return cmp.Compare(a.InternalDate, b.InternalDate)
+		})
+	case "-date":
+		slices.SortStableFunc(messages, func(a, b *gmail.Message) int {
+			return cmp.Compare(b.InternalDate, a.InternalDate)
+		})
+	case "subject":
+		slices.SortStableFunc(messages, func(a, b *gmail.Message) int {
+			subjectA, _ := ExtractHeaders(MessageHeaders(a))
+			subjectB, _ := ExtractHeaders(MessageHeaders(b))
+			return cmp.Compare(strings.ToLower(subjectA), strings.ToLower(subjectB))
+		})
+	}
+}
+
+// FormatInternalDate formats a Gmail internal date (epoch milliseconds) as
+// RFC3339, in the local timezone or in UTC.
+func FormatInternalDate(ms int64, utc bool) string {
+	t := time.UnixMilli(ms)
+	if utc {
+		t = t.UTC()
+	}
+	return t.Format(time.RFC3339)
+}
+
+// Truncate shortens s to at most width characters, marking the cut with "...".
+func Truncate(s string, width int) string {
+	runes := []rune(s)
+	if len(runes) <= width {
+		return s
+	}
+	if width <= 3 {
+		return string(runes[:width])
+	}
+	return string(runes[:width-3]) + "..."
+}
+
+// SanitizeText makes message text safe to print to a terminal: control
+// characters other than newlines and tabs (including the escape character that
+// starts terminal escape sequences) are shown as \xNN or \uNNNN, a carriage
+// return is kept only before a newline and invalid UTF-8 becomes U+FFFD.
+func SanitizeText(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		switch {
+		case r == '\n', r == '\t', r == '\r' && strings.HasPrefix(s[i+1:], "\n"):
+			b.WriteRune(r)
+		case r < 0x80 && unicode.IsControl(r):
+			fmt.Fprintf(&b, "\\x%02x", r)
+		case unicode.IsControl(r):
+			fmt.Fprintf(&b, "\\u%04x", r)
+		default:
+			// Ranging over invalid UTF-8 already yields U+FFFD
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// listPageLimit is the maximum number of messages Messages.List returns per
+// page.
+const listPageLimit = 500
+
+// ListMessagesUpTo runs call until max messages are listed, fetching pages of
+// at most listPageLimit. When more messages match, it also returns Gmail's
+// estimate of their total number.
+func ListMessagesUpTo(call *gmail.UsersMessagesListCall, max int64) ([]*gmail.Message, int64, error) {
+	var messages []*gmail.Message
+	for {
+		response, err := call.MaxResults(min(max-int64(len(messages)), listPageLimit)).Do()
+		if err != nil {
+			return nil, 0, err
+		}
+		messages = append(messages, response.Messages...)
+		if response.NextPageToken == "" {
+			return messages, 0, nil
+		}
+		if int64(len(messages)) >= max {
+			return messages, response.ResultSizeEstimate, nil
+		}
+		call.PageToken(response.NextPageToken)
+	}
+}
+
+// batchModifyLimit is the maximum number of message IDs accepted by BatchModify.
+const batchModifyLimit = 1000
+
+// ModifyLabels adds and removes labels on one or more messages. A single
+// message uses Modify; several messages use BatchModify in chunks.
+func ModifyLabels(service *gmail.Service, messageIDs, add, remove []string) error {
+	if len(messageIDs) == 1 {
+		req := &gmail.ModifyMessageRequest{
+			AddLabelIds:    add,
+			RemoveLabelIds: remove,
+		}
+		_, err := service.Users.Messages.Modify(UserID, messageIDs[0], req).Do()
+		return err
+	}
+
+	for start := 0; start < len(messageIDs); start += batchModifyLimit {
+		end := min(start+batchModifyLimit, len(messageIDs))
+		req := &gmail.BatchModifyMessagesRequest{
+			Ids:            messageIDs[start:end],
+			AddLabelIds:    add,
+			RemoveLabelIds: remove,
+		}
+		if err := service.Users.Messages.BatchModify(UserID, req).Do(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// batchDeleteLimit is the maximum number of message IDs accepted by BatchDelete.
+const batchDeleteLimit = 1000
+
+// DeleteMessages permanently deletes messages, bypassing the trash, using
+// BatchDelete in chunks.
+func DeleteMessages(service *gmail.Service, messageIDs []string) error {
+	for start := 0; start < len(messageIDs); start += batchDeleteLimit {
+		end := min(start+batchDeleteLimit, len(messageIDs))
+		req := &gmail.BatchDeleteMessagesRequest{
+			Ids: messageIDs[start:end],
+		}
+		if err := service.Users.Messages.BatchDelete(UserID, req).Do(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Attachment describes an attachment part of a message.
+type Attachment struct {
+	Filename     string
+	MimeType     string
+	Size         int64
+	AttachmentID string
+}
+
+// ListAttachments walks a message payload and returns its attachment parts
+// without downloading them.
+func ListAttachments(part *gmail.MessagePart) []Attachment {
+	var attachments []Attachment
+	walkParts(part, func(p *gmail.MessagePart) error {
+		if p.Filename != "" && p.Body != nil {
+			attachments = append(attachments, Attachment{
+				Filename:     p.Filename,
+				MimeType:     p.MimeType,
+				Size:         p.Body.Size,
+				AttachmentID: p.Body.AttachmentId,
+			})
+		}
+		return nil
+	})
+	return attachments
+}
+
+// FileAttachments returns the attachments of a message payload that are
+// actual files, leaving out the inline images of the HTML body.
+func FileAttachments(part *gmail.MessagePart) []Attachment {
+	var attachments []Attachment
+	walkParts(part, func(p *gmail.MessagePart) error {
+		if p.Filename != "" && p.Body != nil && !isInlineImage(p) {
+			attachments = append(attachments, Attachment{
+				Filename:     p.Filename,
+				MimeType:     p.MimeType,
+				Size:         p.Body.Size,
+				AttachmentID: p.Body.AttachmentId,
+			})
+		}
+		return nil
+	})
+	return attachments
+}
+
+// isInlineImage reports whether a part is an image displayed within the
+// body: an inline Content-Disposition, or a Content-ID without an attachment
+// disposition. Other inline parts, such as the PDFs some clients mark
+// inline, are still attachments.
+func isInlineImage(part *gmail.MessagePart) bool {
+	if !strings.HasPrefix(part.MimeType, "image/") {
+		return false
+	}
+	disposition, _, _ := mime.ParseMediaType(headerValue(part.Headers, "Content-Disposition"))
+	switch disposition {
+	case "inline":
+		return true
+	case "attachment":
+		return false
+	}
+	return headerValue(part.Headers, "Content-ID") != ""
+}
+
+// CountParts returns the number of MIME parts in a message payload, the
+// payload itself included.
+func CountParts(part *gmail.MessagePart) int {
+	count := 0
+	walkParts(part, func(*gmail.MessagePart) error {
+		count++
+		return nil
+	})
+	return count
+}
+
+// walkParts calls fn for part and each of its descendants, depth first,
+// stopping at the first error.
+func walkParts(part *gmail.MessagePart, fn func(*gmail.MessagePart) error) error {
+	if part == nil {
+		return nil
+	}
+	if err := fn(part); err != nil {
+		return err
+	}
+	for _, subPart := range part.Parts {
+		if err := walkParts(subPart, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FormatSize formats a byte count as a human-readable size.
+func FormatSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+// ProcessAttachments downloads the attachments whose filename matches one of
+// the include patterns (all when empty) to dir, running up to concurrency
+// downloads at once. Filenames are reduced to their base name and made
+// unique, so two attachments with the same name do not overwrite each other.
+// With structured set, each nested multipart or message part gets its own
+// subdirectory (see partDirs) instead of every file landing in dir.
+func ProcessAttachments(service *gmail.Service, messageID string, part *gmail.MessagePart, dir string, include []string, concurrency int, structured bool, count *int) error {
+	var dirs map[*gmail.MessagePart]string
+	if structured {
+		dirs = make(map[*gmail.MessagePart]string)
+		partDirs(part, "", dirs)
+	}
+
+	// Collect first so names are assigned in message order
+	var (
+		parts   []*gmail.MessagePart
+		subDirs []string
+	)
+	walkParts(part, func(p *gmail.MessagePart) error {
+		if p.Filename != "" && p.Body != nil && p.Body.AttachmentId != "" && MatchAttachment(p.Filename, include) {
+			parts = append(parts, p)
+			subDirs = append(subDirs, dirs[p])
+		}
+		return nil
+	})
+	names := attachmentFileNames(parts, subDirs)
+	for _, subDir := range subDirs {
+		if subDir == "" {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Join(dir, subDir), 0755); err != nil {
+			return fmt.Errorf("error creating directory: %w", err)
+		}
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+	)
+	slots := make(chan struct{}, concurrency)
+	for i, p := range parts {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			err := downloadAttachment(service, messageID, p, filepath.Join(dir, subDirs[i], names[i]))
 
-			// Decode the attachment data
-			data, err := base64.URLEncoding.DecodeString(attachment.Data)
+			mu.Lock()
+			defer mu.Unlock()
 			if err != nil {
-				return fmt.Errorf("error decoding attachment %s: %w", part.Filename, err)
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
 			}
+			*count++
+		}()
+	}
+	wg.Wait()
 
-			// Write to file
-			filepath := fmt.Sprintf("%s/%s", dir, part.Filename)
-			if err := os.WriteFile(filepath, data, 0644); err != nil {
-				return fmt.Errorf("error writing file %s: %w", filepath, err)
-			}
+	return firstErr
+}
 
-			fmt.Fprintf(os.Stderr, "Saved: %s\n", filepath)
-			*count++
+// attachmentFileNames returns a safe local filename for each part, unique
+// within its directory in dirs: directories are stripped and repeated names
+// get a " (n)" suffix.
+func attachmentFileNames(parts []*gmail.MessagePart, dirs []string) []string {
+	names := make([]string, len(parts))
+	used := map[string]bool{}
+	for i, part := range parts {
+		name := filepath.Base(strings.ReplaceAll(part.Filename, "\\", "/"))
+		if name == "." || name == "/" || name == ".." {
+			name = "attachment"
 		}
+
+		ext := filepath.Ext(name)
+		stem := strings.TrimSuffix(name, ext)
+		for n := 1; used[strings.ToLower(filepath.Join(dirs[i], name))]; n++ {
+			name = fmt.Sprintf("%s (%d)%s", stem, n, ext)
+		}
+		used[strings.ToLower(filepath.Join(dirs[i], name))] = true
+		names[i] = name
 	}
+	return names
+}
 
-	// Recursively process parts
+// partDirs records in dirs the directory, relative to the download
+// directory, of part and each of its descendants. The children of a
+// multipart or message part other than the payload go into a subdirectory
+// named after its part ID and MIME type, e.g. "1 message-rfc822" for a
+// forwarded message, so its attachments keep their context.
+func partDirs(part *gmail.MessagePart, dir string, dirs map[*gmail.MessagePart]string) {
+	if part == nil {
+		return
+	}
+	dirs[part] = dir
 	for _, subPart := range part.Parts {
-		if err := ProcessAttachments(service, messageID, subPart, dir, count); err != nil {
-			return err
+		subDir := dir
+		if len(subPart.Parts) > 0 {
+			index := subPart.PartId[strings.LastIndex(subPart.PartId, ".")+1:]
+			subDir = filepath.Join(dir, pathComponent(index+" "+strings.ReplaceAll(subPart.MimeType, "/", "-")))
 		}
+		partDirs(subPart, subDir, dirs)
 	}
+}
 
+// MatchAttachment reports whether filename matches one of the glob patterns,
+// case-insensitively. An empty pattern list matches every file.
+func MatchAttachment(filename string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(strings.ToLower(pattern), strings.ToLower(filename)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// downloadAttachment streams the attachment part to path, removing the
+// partial file if the download fails.
+func downloadAttachment(service *gmail.Service, messageID string, part *gmail.MessagePart, path string) error {
+	fmt.Fprintf(os.Stderr, "Downloading: %s\n", part.Filename)
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("error writing file %s: %w", path, err)
+	}
+
+	_, err = StreamAttachment(service, messageID, part.Body.AttachmentId, file)
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("error downloading attachment %s: %w", part.Filename, err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Saved: %s\n", path)
 	return nil
 }
 
@@ -137,3 +906,67 @@ func ExpandTilde(path string) (string, error) {
 	}
 	return dir, nil
 }
+
+// ExpandDirTemplate expands ~ and environment variables in path like
+// ExpandTilde, then replaces the {date} (received date, YYYY-MM-DD), {from}
+// (sender address) and {subject} placeholders with values from msg, made safe
+// for use as a single path component.
+func ExpandDirTemplate(path string, msg *gmail.Message) (string, error) {
+	// Expand first so that $ in a subject is not taken for a variable
+	dir, err := ExpandTilde(path)
+	if err != nil {
+		return "", err
+	}
+	if !strings.Contains(dir, "{") {
+		return dir, nil
+	}
+
+	subject, from := ExtractHeaders(MessageHeaders(msg))
+	if address, err := mail.ParseAddress(from); err == nil {
+		from = address.Address
+	}
+
+	replacer := strings.NewReplacer(
+		"{date}", time.UnixMilli(msg.InternalDate).Format("2006-01-02"),
+		"{from}", pathComponent(from),
+		"{subject}", pathComponent(subject),
+	)
+	return replacer.Replace(dir), nil
+}
+
+// shortIDLength is the number of trailing message ID characters in the names
+// given by MessageFileName.
+const shortIDLength = 8
+
+// MessageFileName names a saved message <YYYYMMDD>_<subject>_<shortid><ext>
+// from its received date, subject (made safe like {subject} in
+// ExpandDirTemplate) and the end of its ID. subject is passed in because raw
+// messages come without parsed headers.
+func MessageFileName(msg *gmail.Message, subject, ext string) string {
+	id := msg.Id
+	if len(id) > shortIDLength {
+		id = id[len(id)-shortIDLength:]
+	}
+	date := time.UnixMilli(msg.InternalDate).Format("20060102")
+	return date + "_" + pathComponent(cmp.Or(subject, "no subject")) + "_" + id + ext
+}
+
+// pathComponent turns a header value into a directory name: separators and
+// control characters become underscores, surrounding spaces and dots are
+// trimmed and the result is capped at 100 characters.
+func pathComponent(value string) string {
+	name := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ':' || unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, value)
+	name = strings.Trim(name, " .")
+	if runes := []rune(name); len(runes) > 100 {
+		name = strings.TrimRight(string(runes[:100]), " .")
+	}
+	if name == "" {
+		return "unknown"
+	}
+	return name
+}
@@ -0,0 +1,109 @@
+package gmail
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+)
+
+// withHeaders returns a message with a text/plain payload and the given
+// headers.
+func withHeaders() *gmail.Message {
+	return &gmail.Message{
+		Id:       "m1",
+		ThreadId: "t1",
+		Payload: &gmail.MessagePart{
+			MimeType: "text/plain",
+			Headers: []*gmail.MessagePartHeader{
+				{Name: "From", Value: "alice@example.com"},
+				{Name: "Subject", Value: "Hello"},
+			},
+			Body: &gmail.MessagePartBody{Data: base64.URLEncoding.EncodeToString([]byte("Hi there"))},
+		},
+	}
+}
+
+// captureStdout returns what fn prints on stdout.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	done := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		done <- string(data)
+	}()
+	fn()
+	w.Close()
+	return <-done
+}
+
+func TestMessageHeaders(t *testing.T) {
+	if headers := MessageHeaders(&gmail.Message{Id: "m1"}); headers != nil {
+		t.Errorf("MessageHeaders(no payload) = %v, want nil", headers)
+	}
+
+	headers := MessageHeaders(withHeaders())
+	if len(headers) != 2 || headers[0].Name != "From" || headers[1].Value != "Hello" {
+		t.Errorf("MessageHeaders = %v, want the payload headers", headers)
+	}
+}
+
+func TestGetBody(t *testing.T) {
+	if body := GetBody(nil); body != "[No content available]" {
+		t.Errorf("GetBody(nil) = %q", body)
+	}
+	if body := GetBody(withHeaders().Payload); body != "Hi there" {
+		t.Errorf("GetBody = %q, want %q", body, "Hi there")
+	}
+}
+
+func TestListMessagesWithDetails(t *testing.T) {
+	messages := map[string]*gmail.Message{
+		"m1": withHeaders(),
+		"m2": {Id: "m2", ThreadId: "t2"},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		msg, ok := messages[id]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(msg)
+	}))
+	defer server.Close()
+
+	service, err := gmail.NewService(context.Background(), option.WithEndpoint(server.URL+"/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var listErr error
+	out := captureStdout(t, func() {
+		listErr = ListMessagesWithDetails(service, []*gmail.Message{{Id: "m1"}, {Id: "m2"}}, ListOptions{})
+	})
+	if listErr != nil {
+		t.Fatal(listErr)
+	}
+	for _, want := range []string{"ID: m1", "From: alice@example.com", "Subject: Hello", "ID: m2"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package gmail
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"email-manager/pkg/auth"
+)
+
+// SyncStatePath returns the file holding the history ID the sync command
+// resumes from, per mailbox.
+func SyncStatePath() string {
+	return filepath.Join(auth.DataDir(), "sync.json")
+}
+
+// LoadSyncState returns the history ID stored for the current mailbox, or 0
+// when it was never synced.
+func LoadSyncState() (uint64, error) {
+	state, err := loadSyncStates()
+	if err != nil {
+		return 0, err
+	}
+	return state[UserID], nil
+}
+
+// SaveSyncState stores the history ID the next sync of the current mailbox
+// starts from.
+func SaveSyncState(historyID uint64) error {
+	state, err := loadSyncStates()
+	if err != nil {
+		return err
+	}
+	state[UserID] = historyID
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := SyncStatePath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("error creating data directory: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("error writing sync state: %w", err)
+	}
+	return nil
+}
+
+// loadSyncStates returns the stored history IDs by mailbox.
+func loadSyncStates() (map[string]uint64, error) {
+	state := make(map[string]uint64)
+	data, err := os.ReadFile(SyncStatePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading sync state: %w", err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("error parsing sync state %s: %w", SyncStatePath(), err)
+	}
+	return state, nil
+}
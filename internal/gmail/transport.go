@@ -0,0 +1,100 @@
+package gmail
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// accepted is set once an API request gets a response other than 401.
+var accepted atomic.Bool
+
+// RequestAccepted reports whether any API request was accepted, so a token
+// rejected on the first request can be told apart from one revoked after
+// the command already changed something.
+func RequestAccepted() bool {
+	return accepted.Load()
+}
+
+// acceptTransport records in accepted the requests that went through.
+type acceptTransport struct {
+	base http.RoundTripper
+}
+
+func (t *acceptTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && resp.StatusCode != http.StatusUnauthorized {
+		accepted.Store(true)
+	}
+	return resp, err
+}
+
+// requestStats accumulates the timings of logged API requests.
+type requestStats struct {
+	mu      sync.Mutex
+	start   time.Time
+	count   int
+	total   time.Duration
+	slowest time.Duration
+	slowReq string
+}
+
+// stats is nil unless request logging is enabled.
+var stats *requestStats
+
+// EnableRequestLogging makes services returned by GetService log the method,
+// path, status and duration of every API request to stderr.
+func EnableRequestLogging() {
+	stats = &requestStats{start: time.Now()}
+}
+
+// PrintRequestSummary prints the number of logged requests, the wall time
+// since logging was enabled and the slowest request. It does nothing when
+// request logging is disabled.
+func PrintRequestSummary() {
+	if stats == nil {
+		return
+	}
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	fmt.Fprintf(os.Stderr, "%d request(s) in %s (wall time %s)",
+		stats.count, stats.total.Round(time.Millisecond), time.Since(stats.start).Round(time.Millisecond))
+	if stats.count > 0 {
+		fmt.Fprintf(os.Stderr, ", slowest: %s (%s)", stats.slowReq, stats.slowest.Round(time.Millisecond))
+	}
+	fmt.Fprintln(os.Stderr)
+}
+
+// loggingTransport logs each request it forwards to base and records its timing.
+type loggingTransport struct {
+	base http.RoundTripper
+}
+
+func (t *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	elapsed := time.Since(start)
+
+	status := "error"
+	if err == nil {
+		status = fmt.Sprint(resp.StatusCode)
+	}
+	request := req.Method + " " + req.URL.Path
+	fmt.Fprintf(os.Stderr, "%s -> %s (%s)\n", request, status, elapsed.Round(time.Millisecond))
+
+	stats.mu.Lock()
+	stats.count++
+	stats.total += elapsed
+	if elapsed > stats.slowest {
+		stats.slowest = elapsed
+		stats.slowReq = request
+	}
+	stats.mu.Unlock()
+
+	return resp, err
+}
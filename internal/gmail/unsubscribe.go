@@ -0,0 +1,87 @@
+package gmail
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// UnsubscribeTimeout bounds the one-click unsubscribe request.
+const UnsubscribeTimeout = 30 * time.Second
+
+// Unsubscribe holds the unsubscribe methods a message offers in its
+// List-Unsubscribe header (RFC 2369).
+type Unsubscribe struct {
+	// Mailto is the first mailto: URI, e.g. "mailto:leave@example.com?subject=unsubscribe".
+	Mailto string
+	// URL is the first https: (or http:) URI.
+	URL string
+	// OneClick is set when List-Unsubscribe-Post asks for a one-click POST
+	// to URL (RFC 8058).
+	OneClick bool
+}
+
+// ParseUnsubscribe reads the List-Unsubscribe and List-Unsubscribe-Post
+// headers. It returns false when the message offers no usable method.
+func ParseUnsubscribe(headers []*gmail.MessagePartHeader) (Unsubscribe, bool) {
+	var unsubscribe Unsubscribe
+	for _, entry := range strings.Split(headerValue(headers, "List-Unsubscribe"), ",") {
+		uri := strings.Trim(strings.TrimSpace(entry), "<>")
+		scheme, _, _ := strings.Cut(uri, ":")
+		switch strings.ToLower(scheme) {
+		case "mailto":
+			if unsubscribe.Mailto == "" {
+				unsubscribe.Mailto = uri
+			}
+		case "https", "http":
+			if unsubscribe.URL == "" {
+				unsubscribe.URL = uri
+			}
+		}
+	}
+	post := headerValue(headers, "List-Unsubscribe-Post")
+	unsubscribe.OneClick = unsubscribe.URL != "" && strings.EqualFold(strings.ReplaceAll(post, " ", ""), "List-Unsubscribe=One-Click")
+	return unsubscribe, unsubscribe.Mailto != "" || unsubscribe.URL != ""
+}
+
+// UnsubscribeEmail builds the message requested by a mailto: unsubscribe
+// URI, using its subject and body parameters when present.
+func UnsubscribeEmail(mailto string) (*Email, error) {
+	u, err := url.Parse(mailto)
+	if err != nil || u.Opaque == "" {
+		return nil, fmt.Errorf("invalid unsubscribe address %q", mailto)
+	}
+	to, err := url.PathUnescape(u.Opaque)
+	if err != nil {
+		return nil, fmt.Errorf("invalid unsubscribe address %q: %w", mailto, err)
+	}
+
+	email := &Email{
+		To:      to,
+		Subject: u.Query().Get("subject"),
+		Body:    u.Query().Get("body"),
+	}
+	if email.Subject == "" {
+		email.Subject = "unsubscribe"
+	}
+	return email, nil
+}
+
+// UnsubscribeOneClick sends the RFC 8058 one-click unsubscribe POST to
+// rawURL.
+func UnsubscribeOneClick(rawURL string) error {
+	client := &http.Client{Timeout: UnsubscribeTimeout}
+	resp, err := client.Post(rawURL, "application/x-www-form-urlencoded", strings.NewReader("List-Unsubscribe=One-Click"))
+	if err != nil {
+		return fmt.Errorf("error unsubscribing: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("error unsubscribing: %s returned %s", rawURL, resp.Status)
+	}
+	return nil
+}
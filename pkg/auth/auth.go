@@ -4,14 +4,18 @@
 package auth
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strings"
 	"time"
 
 	"golang.org/x/oauth2"
@@ -27,20 +31,75 @@ const (
 	TokenFile = "google_token.json"
 )
 
-// Scopes contains all OAuth2 scopes for Gmail and People APIs.
-// These unified scopes enable a single OAuth consent for both email-manager
-// and google-contacts applications, using the same token file.
-var Scopes = []string{
-	// Gmail API scopes (for email-manager)
+// Environment variables holding the OAuth credentials and token JSON, used
+// instead of the files when set so secrets can be injected into containers
+// and CI jobs without writing them to disk.
+const (
+	CredentialsEnv = "GMAIL_CREDENTIALS_JSON"
+	TokenEnv       = "GMAIL_TOKEN_JSON"
+)
+
+// GmailScopes contains the Gmail API scopes (for email-manager).
+var GmailScopes = []string{
+	gmail.MailGoogleComScope,
 	gmail.GmailModifyScope,
 	gmail.GmailSendScope,
 	gmail.GmailLabelsScope,
-	// People API scopes (for google-contacts)
+	gmail.GmailSettingsBasicScope,
+}
+
+// PeopleScopes contains the People API scopes (for google-contacts).
+var PeopleScopes = []string{
 	people.ContactsScope,
 	people.ContactsOtherReadonlyScope,
 }
 
-// GetCredentialsPath returns the path to the credentials directory.
+// Scopes contains all OAuth2 scopes for Gmail and People APIs.
+// These unified scopes enable a single OAuth consent for both email-manager
+// and google-contacts applications, using the same token file.
+var Scopes = append(append([]string{}, GmailScopes...), PeopleScopes...)
+
+// ScopePresets are the Gmail scopes requested for each --scopes preset, from
+// least to most privileged: readonly cannot change anything, modify cannot
+// delete permanently, full is GmailScopes.
+var ScopePresets = map[string][]string{
+	"readonly": {gmail.GmailReadonlyScope},
+	"modify": {
+		gmail.GmailModifyScope,
+		gmail.GmailSendScope,
+		gmail.GmailLabelsScope,
+		gmail.GmailSettingsBasicScope,
+	},
+	"full": GmailScopes,
+}
+
+// ScopePreset selects the ScopePresets entry requested when authorizing. The
+// full preset also requests PeopleScopes, keeping the token usable by
+// google-contacts. It has no effect on an existing token.
+var ScopePreset = "full"
+
+// NoBrowser makes the OAuth2 flow print the authorization URL and read the
+// code from stdin instead of opening a browser and waiting for the callback,
+// for SSH sessions and headless machines.
+var NoBrowser bool
+
+// Verbose makes the OAuth2 flow print the scopes actually granted, which may
+// be fewer than requested when boxes are left unchecked on the consent page.
+var Verbose bool
+
+// Service account settings. When ServiceAccountFile is set, GetClient
+// authenticates with that JSON key and domain-wide delegation instead of the
+// interactive OAuth2 flow, acting as the Impersonate user.
+var (
+	ServiceAccountFile string
+	Impersonate        string
+)
+
+// AppName names the application directories under the XDG base directories.
+const AppName = "email-manager"
+
+// GetCredentialsPath returns the path to the legacy credentials directory
+// (~/.credentials), still used when the files are found there.
 func GetCredentialsPath() string {
 	home, err := os.UserHomeDir()
 	if err != nil {
@@ -49,28 +108,112 @@ func GetCredentialsPath() string {
 	return filepath.Join(home, ".credentials")
 }
 
-// GetClient returns an HTTP client with OAuth2 authentication.
+// xdgDir returns $<env>/email-manager, or ~/<fallback>/email-manager when
+// the variable is unset or not absolute, as the XDG spec requires.
+func xdgDir(env, fallback string) string {
+	if dir := os.Getenv(env); filepath.IsAbs(dir) {
+		return filepath.Join(dir, AppName)
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, fallback, AppName)
+}
+
+// CredentialsFilePath returns the OAuth credentials file: the legacy
+// ~/.credentials one if it exists, otherwise $XDG_CONFIG_HOME/email-manager.
+func CredentialsFilePath() string {
+	legacy := filepath.Join(GetCredentialsPath(), CredentialsFile)
+	if _, err := os.Stat(legacy); err == nil {
+		return legacy
+	}
+	return filepath.Join(ConfigDir(), CredentialsFile)
+}
+
+// TokenFilePath returns the token file: the legacy ~/.credentials one if it
+// exists or if the credentials are still stored there (so the token stays
+// shared with google-contacts), otherwise $XDG_DATA_HOME/email-manager.
+func TokenFilePath() string {
+	legacyDir := GetCredentialsPath()
+	for _, name := range []string{TokenFile, CredentialsFile} {
+		if _, err := os.Stat(filepath.Join(legacyDir, name)); err == nil {
+			return filepath.Join(legacyDir, TokenFile)
+		}
+	}
+	return filepath.Join(xdgDir("XDG_DATA_HOME", ".local/share"), TokenFile)
+}
+
+// ConfigDir returns the configuration directory, $XDG_CONFIG_HOME/email-manager.
+func ConfigDir() string {
+	return xdgDir("XDG_CONFIG_HOME", ".config")
+}
+
+// CacheDir returns the cache directory, $XDG_CACHE_HOME/email-manager.
+func CacheDir() string {
+	return xdgDir("XDG_CACHE_HOME", ".cache")
+}
+
+// DataDir returns the data directory, $XDG_DATA_HOME/email-manager.
+func DataDir() string {
+	return xdgDir("XDG_DATA_HOME", ".local/share")
+}
+
+// GetClient returns an HTTP client with OAuth2 authentication, using the
+// service account when ServiceAccountFile is set.
 func GetClient(ctx context.Context) (*http.Client, error) {
-	credPath := filepath.Join(GetCredentialsPath(), CredentialsFile)
-	tokenPath := filepath.Join(GetCredentialsPath(), TokenFile)
+	if ServiceAccountFile != "" {
+		return getServiceAccountClient(ctx)
+	}
 
-	b, err := os.ReadFile(credPath)
-	if err != nil {
-		return nil, fmt.Errorf("unable to read credentials file %s: %w", credPath, err)
+	b := []byte(os.Getenv(CredentialsEnv))
+	if len(b) == 0 {
+		credPath := CredentialsFilePath()
+		var err error
+		b, err = os.ReadFile(credPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read credentials file %s: %w", credPath, err)
+		}
+	}
+
+	scopes, ok := ScopePresets[ScopePreset]
+	if !ok {
+		return nil, fmt.Errorf("invalid scopes preset %q: use readonly, modify or full", ScopePreset)
+	}
+	if ScopePreset == "full" {
+		scopes = Scopes
 	}
 
-	config, err := google.ConfigFromJSON(b, Scopes...)
+	config, err := google.ConfigFromJSON(b, scopes...)
 	if err != nil {
 		return nil, fmt.Errorf("unable to parse credentials: %w", err)
 	}
 
+	// A token from the environment is refreshed in memory only
+	if value := os.Getenv(TokenEnv); value != "" {
+		token := &oauth2.Token{}
+		if err := json.Unmarshal([]byte(value), token); err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %w", TokenEnv, err)
+		}
+		return config.Client(ctx, token), nil
+	}
+
+	tokenPath := TokenFilePath()
 	token, err := tokenFromFile(tokenPath)
 	if err != nil {
-		token, err = getTokenFromWeb(config)
+		if NoBrowser {
+			token, err = getTokenFromPrompt(config)
+		} else {
+			token, err = getTokenFromWeb(config)
+		}
 		if err != nil {
 			return nil, err
 		}
-		if err := saveToken(tokenPath, token); err != nil {
+		granted := grantedScopes(ctx, token)
+		if Verbose {
+			printGrantedScopes(granted, config.Scopes)
+		}
+		if err := saveToken(tokenPath, token, granted); err != nil {
 			fmt.Fprintf(os.Stderr, "Warning: unable to save token: %v\n", err)
 		}
 	}
@@ -78,6 +221,34 @@ func GetClient(ctx context.Context) (*http.Client, error) {
 	return config.Client(ctx, token), nil
 }
 
+// getServiceAccountClient returns an HTTP client authenticated as the
+// Impersonate user through the service account's domain-wide delegation.
+// Only the Gmail scopes are requested, so only those need to be granted to
+// the service account in the Google Workspace admin console.
+func getServiceAccountClient(ctx context.Context) (*http.Client, error) {
+	if Impersonate == "" {
+		return nil, fmt.Errorf("a user to impersonate is required with a service account")
+	}
+
+	b, err := os.ReadFile(ServiceAccountFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read service account file %s: %w", ServiceAccountFile, err)
+	}
+
+	scopes, ok := ScopePresets[ScopePreset]
+	if !ok {
+		return nil, fmt.Errorf("invalid scopes preset %q: use readonly, modify or full", ScopePreset)
+	}
+
+	config, err := google.JWTConfigFromJSON(b, scopes...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse service account key: %w", err)
+	}
+	config.Subject = Impersonate
+
+	return config.Client(ctx), nil
+}
+
 func getTokenFromWeb(config *oauth2.Config) (*oauth2.Token, error) {
 	// Use localhost with configured port
 	config.RedirectURL = "http://localhost:8080/oauth2callback"
@@ -122,25 +293,15 @@ func getTokenFromWeb(config *oauth2.Config) (*oauth2.Token, error) {
 	// Wait a moment for server to start
 	time.Sleep(100 * time.Millisecond)
 
-	// Generate auth URL
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
+	// Generate auth URL. PKCE binds the code to this process, so a code
+	// intercepted on its way to the callback cannot be exchanged elsewhere
+	verifier := oauth2.GenerateVerifier()
+	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline, oauth2.S256ChallengeOption(verifier))
 	fmt.Printf("Opening browser for authentication...\n")
 	fmt.Printf("If browser doesn't open, visit:\n%v\n\n", authURL)
 
 	// Try to open browser automatically
-	var cmd *exec.Cmd
-	switch runtime.GOOS {
-	case "darwin":
-		cmd = exec.Command("open", authURL)
-	case "linux":
-		cmd = exec.Command("xdg-open", authURL)
-	case "windows":
-		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", authURL)
-	}
-
-	if cmd != nil {
-		_ = cmd.Start()
-	}
+	_ = OpenBrowser(authURL)
 
 	// Wait for auth code or error
 	var code string
@@ -159,7 +320,7 @@ func getTokenFromWeb(config *oauth2.Config) (*oauth2.Token, error) {
 	_ = server.Shutdown(ctx)
 
 	// Exchange code for token
-	tok, err := config.Exchange(context.Background(), code)
+	tok, err := config.Exchange(context.Background(), code, oauth2.VerifierOption(verifier))
 	if err != nil {
 		return nil, fmt.Errorf("unable to retrieve token from web: %w", err)
 	}
@@ -168,6 +329,117 @@ func getTokenFromWeb(config *oauth2.Config) (*oauth2.Token, error) {
 	return tok, nil
 }
 
+// OpenBrowser opens rawURL in the default browser without waiting for it.
+func OpenBrowser(rawURL string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", rawURL)
+	case "linux":
+		cmd = exec.Command("xdg-open", rawURL)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", rawURL)
+	default:
+		return fmt.Errorf("no known way to open a browser on %s", runtime.GOOS)
+	}
+	return cmd.Start()
+}
+
+// getTokenFromPrompt runs the OAuth2 flow without a local callback server:
+// the user opens the URL on any machine and pastes back the code, or the
+// whole localhost URL the browser was redirected to.
+func getTokenFromPrompt(config *oauth2.Config) (*oauth2.Token, error) {
+	config.RedirectURL = "http://localhost:8080/oauth2callback"
+
+	verifier := oauth2.GenerateVerifier()
+	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline, oauth2.S256ChallengeOption(verifier))
+	fmt.Fprintf(os.Stderr, "Visit this URL in a browser on any machine:\n%v\n\n", authURL)
+	fmt.Fprintf(os.Stderr, "After approving, the browser is redirected to a localhost page that fails to load.\n")
+	fmt.Fprintf(os.Stderr, "Paste that page's address (or its code parameter) here: ")
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return nil, fmt.Errorf("unable to read authorization code: %w", err)
+	}
+
+	code := strings.TrimSpace(line)
+	if u, err := url.Parse(code); err == nil && u.Query().Get("code") != "" {
+		code = u.Query().Get("code")
+	}
+	if code == "" {
+		return nil, fmt.Errorf("no authorization code given")
+	}
+
+	tok, err := config.Exchange(context.Background(), code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve token from code: %w", err)
+	}
+
+	fmt.Fprintln(os.Stderr, "\nAuthentication successful!")
+	return tok, nil
+}
+
+// grantedScopes returns the scopes granted to a new token, or nil when they
+// cannot be found out. The token response includes them; the tokeninfo
+// endpoint is asked when it does not.
+func grantedScopes(ctx context.Context, token *oauth2.Token) []string {
+	scope, _ := token.Extra("scope").(string)
+	if scope == "" {
+		info, err := tokenInfo(ctx, token.AccessToken)
+		if err != nil {
+			if Verbose {
+				fmt.Fprintf(os.Stderr, "Warning: unable to check granted scopes: %v\n", err)
+			}
+			return nil
+		}
+		scope = info
+	}
+	return strings.Fields(scope)
+}
+
+// printGrantedScopes lists the granted scopes and warns about the requested
+// ones that were not.
+func printGrantedScopes(granted, requested []string) {
+	if granted == nil {
+		return
+	}
+	fmt.Fprintln(os.Stderr, "Granted scopes:")
+	for _, s := range granted {
+		fmt.Fprintf(os.Stderr, "  %s\n", s)
+	}
+	for _, s := range requested {
+		if !slices.Contains(granted, s) {
+			fmt.Fprintf(os.Stderr, "Warning: scope not granted: %s\n", s)
+		}
+	}
+}
+
+// tokenInfo returns the space-separated scopes of an access token from
+// Google's tokeninfo endpoint.
+func tokenInfo(ctx context.Context, accessToken string) (string, error) {
+	endpoint := "https://oauth2.googleapis.com/tokeninfo?access_token=" + url.QueryEscape(accessToken)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("tokeninfo: %s", resp.Status)
+	}
+
+	var info struct {
+		Scope string `json:"scope"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", fmt.Errorf("tokeninfo: %w", err)
+	}
+	return info.Scope, nil
+}
+
 func tokenFromFile(file string) (*oauth2.Token, error) {
 	f, err := os.Open(file)
 	if err != nil {
@@ -180,7 +452,55 @@ func tokenFromFile(file string) (*oauth2.Token, error) {
 	return token, err
 }
 
-func saveToken(path string, token *oauth2.Token) error {
+// RemoveSavedToken deletes the token file so that the next GetClient
+// authorizes again. It returns false when the token does not come from the
+// file (environment token, service account) or the file cannot be removed.
+func RemoveSavedToken() bool {
+	if ServiceAccountFile != "" || os.Getenv(TokenEnv) != "" {
+		return false
+	}
+	return os.Remove(TokenFilePath()) == nil
+}
+
+// storedToken is the token file format: the token plus the scopes granted
+// to it, which other readers of the file (google-contacts) ignore.
+type storedToken struct {
+	*oauth2.Token
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// TokenPreset returns the most privileged scopes preset the saved token was
+// granted, or "" when unknown: no token yet, a token from the environment or
+// a service account, or a token saved before scopes were recorded.
+func TokenPreset() string {
+	if ServiceAccountFile != "" {
+		return ScopePreset
+	}
+	if os.Getenv(TokenEnv) != "" {
+		return ""
+	}
+	data, err := os.ReadFile(TokenFilePath())
+	if err != nil {
+		return ""
+	}
+	var stored struct {
+		Scopes []string `json:"scopes"`
+	}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return ""
+	}
+	switch {
+	case slices.Contains(stored.Scopes, gmail.MailGoogleComScope):
+		return "full"
+	case slices.Contains(stored.Scopes, gmail.GmailModifyScope):
+		return "modify"
+	case slices.Contains(stored.Scopes, gmail.GmailReadonlyScope):
+		return "readonly"
+	}
+	return ""
+}
+
+func saveToken(path string, token *oauth2.Token, scopes []string) error {
 	fmt.Fprintf(os.Stderr, "Saving credentials to: %s\n", path)
 
 	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
@@ -193,5 +513,5 @@ func saveToken(path string, token *oauth2.Token) error {
 	}
 	defer f.Close()
 
-	return json.NewEncoder(f).Encode(token)
+	return json.NewEncoder(f).Encode(storedToken{Token: token, Scopes: scopes})
 }